@@ -0,0 +1,150 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver
+
+import (
+    "encoding/json"
+    "errors"
+    "io"
+    "net"
+    "net/http"
+    "strconv"
+    "sync"
+
+    "github.com/docker/docker/api/types"
+    "github.com/docker/docker/client"
+    "golang.org/x/net/context"
+)
+
+const (
+    cgroupV1 = 1
+    cgroupV2 = 2
+)
+
+// What we need from the daemon's /info, none of it can change without a daemon restart
+type daemonInfo struct {
+    cgroupVersion int
+    cpus int
+}
+
+// Daemon info per daemon host, fetched once
+var daemonInfos = struct {
+    sync.Mutex
+    byHost map[string]daemonInfo
+}{byHost: make(map[string]daemonInfo)}
+
+// Get the cgroup version the daemon runs containers under
+func daemonCgroupVersion(ctx context.Context, cli *client.Client) (int, error) {
+    info, err := getDaemonInfo(ctx, cli)
+    return info.cgroupVersion, err
+}
+
+// Get the daemon host's core count
+func daemonCPUs(ctx context.Context, cli *client.Client) (int, error) {
+    info, err := getDaemonInfo(ctx, cli)
+    return info.cpus, err
+}
+
+// Fetch the daemon's info, or return it from the cache
+// types.Info in our pinned client predates the CgroupVersion field, so /info
+// is fetched directly
+func getDaemonInfo(ctx context.Context, cli *client.Client) (daemonInfo, error) {
+    daemonInfos.Lock()
+    info, ok := daemonInfos.byHost[cli.DaemonHost()]
+    daemonInfos.Unlock()
+    if ok {
+        return info, nil
+    }
+
+    dial := cli.Dialer()
+    httpClient := http.Client{
+        Transport: &http.Transport{
+            DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+                return dial(ctx)
+            },
+        },
+    }
+    defer httpClient.CloseIdleConnections()
+
+    // Host is ignored, the dialer always connects to the daemon
+    req, err := http.NewRequest(http.MethodGet, "http://docker/info", nil)
+    if err != nil {
+        return daemonInfo{}, err
+    }
+    resp, err := httpClient.Do(req.WithContext(ctx))
+    if err != nil {
+        return daemonInfo{}, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return daemonInfo{}, errors.New("docker_driver: Error daemon info returned " + resp.Status)
+    }
+
+    info, err = parseDaemonInfo(resp.Body)
+    if err != nil {
+        return daemonInfo{}, err
+    }
+
+    daemonInfos.Lock()
+    daemonInfos.byHost[cli.DaemonHost()] = info
+    daemonInfos.Unlock()
+
+    return info, nil
+}
+
+// Extract what we need from a daemon /info response body
+// Daemons too old to report a cgroup version only support cgroup v1
+func parseDaemonInfo(body io.Reader) (daemonInfo, error) {
+    var raw struct {
+        CgroupVersion string
+        NCPU int
+    }
+    err := json.NewDecoder(body).Decode(&raw)
+    if err != nil {
+        return daemonInfo{}, err
+    }
+
+    info := daemonInfo{cgroupVersion: cgroupV1, cpus: raw.NCPU}
+    if raw.CgroupVersion == "" {
+        return info, nil
+    }
+
+    version, err := strconv.Atoi(raw.CgroupVersion)
+    if err != nil || (version != cgroupV1 && version != cgroupV2) {
+        return daemonInfo{}, errors.New("docker_driver: Error unknown cgroup version " + raw.CgroupVersion)
+    }
+    info.cgroupVersion = version
+    return info, nil
+}
+
+// Memory in use by the container, excluding reclaimable page cache
+// Matches the docker CLI: cgroup v2 subtracts inactive_file, cgroup v1
+// subtracts total_inactive_file, or cache on kernels that lack it
+func memoryUsage(stats *types.MemoryStats, cgroupVersion int) uint64 {
+    var reclaimable uint64
+    if cgroupVersion == cgroupV2 {
+        reclaimable = stats.Stats["inactive_file"]
+    } else if inactive, ok := stats.Stats["total_inactive_file"]; ok {
+        reclaimable = inactive
+    } else {
+        reclaimable = stats.Stats["cache"]
+    }
+
+    if reclaimable > stats.Usage {
+        return stats.Usage
+    }
+    return stats.Usage - reclaimable
+}
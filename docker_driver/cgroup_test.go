@@ -0,0 +1,132 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver
+
+import (
+    "encoding/json"
+    "math"
+    "os"
+    "strings"
+    "testing"
+
+    "github.com/docker/docker/api/types"
+)
+
+// Unit tests against recorded daemon responses, no daemon needed
+
+func loadStatsFixture(test *testing.T, path string) types.StatsJSON {
+    file, err := os.Open(path)
+    if err != nil {
+        test.Fatalf("Open() failed with error:\n%v", err)
+    }
+    defer file.Close()
+
+    var stats types.StatsJSON
+    err = json.NewDecoder(file).Decode(&stats)
+    if err != nil {
+        test.Fatalf("Decode() failed with error:\n%v", err)
+    }
+    return stats
+}
+
+func TestParseDaemonInfo(test *testing.T) {
+    cases := []struct {
+        fixture string
+        expected int
+    }{
+        {"testdata/info_cgroup_v1.json", cgroupV1},
+        {"testdata/info_cgroup_v2.json", cgroupV2},
+    }
+
+    for _, c := range cases {
+        file, err := os.Open(c.fixture)
+        if err != nil {
+            test.Fatalf("Open() failed with error:\n%v", err)
+        }
+
+        info, err := parseDaemonInfo(file)
+        file.Close()
+        if err != nil {
+            test.Errorf("parseDaemonInfo(%s) returned:\n%v", c.fixture, err)
+        }
+        if info.cgroupVersion != c.expected || info.cpus != 2 {
+            test.Errorf("parseDaemonInfo(%s) returned cgroup v%d with %d CPUs, expected v%d with 2",
+                c.fixture, info.cgroupVersion, info.cpus, c.expected)
+        }
+    }
+
+    // Old daemons do not report a version
+    info, err := parseDaemonInfo(strings.NewReader(`{"NCPU": 4}`))
+    if err != nil || info.cgroupVersion != cgroupV1 || info.cpus != 4 {
+        test.Errorf("parseDaemonInfo() returned %+v, %v, expected cgroup v1 with 4 CPUs", info, err)
+    }
+
+    _, err = parseDaemonInfo(strings.NewReader(`{"CgroupVersion": "3"}`))
+    if err == nil {
+        test.Errorf("parseDaemonInfo() succeeded with unknown version, expected it to fail")
+    }
+}
+
+func TestMemoryUsage(test *testing.T) {
+    test.Run("cgroup-v1", func(test *testing.T) {
+        stats := loadStatsFixture(test, "testdata/stats_cgroup_v1.json")
+
+        // usage - total_inactive_file
+        usage := memoryUsage(&stats.MemoryStats, cgroupV1)
+        if usage != 6258688 {
+            test.Errorf("memoryUsage() returned %d, expected 6258688", usage)
+        }
+
+        percent := calculateContainerMemory(&stats.MemoryStats, cgroupV1)
+        if math.Abs(percent - 59.6875) > 1e-9 {
+            test.Errorf("calculateContainerMemory() returned %v, expected 59.6875", percent)
+        }
+    })
+
+    test.Run("cgroup-v1-cache-only", func(test *testing.T) {
+        stats := loadStatsFixture(test, "testdata/stats_cgroup_v1.json")
+        delete(stats.MemoryStats.Stats, "total_inactive_file")
+
+        // usage - cache, for kernels that do not report total_inactive_file
+        usage := memoryUsage(&stats.MemoryStats, cgroupV1)
+        if usage != 5177344 {
+            test.Errorf("memoryUsage() returned %d, expected 5177344", usage)
+        }
+    })
+
+    test.Run("cgroup-v2", func(test *testing.T) {
+        stats := loadStatsFixture(test, "testdata/stats_cgroup_v2.json")
+
+        // usage - inactive_file
+        usage := memoryUsage(&stats.MemoryStats, cgroupV2)
+        if usage != 6258688 {
+            test.Errorf("memoryUsage() returned %d, expected 6258688", usage)
+        }
+
+        percent := calculateContainerMemory(&stats.MemoryStats, cgroupV2)
+        if math.Abs(percent - 59.6875) > 1e-9 {
+            test.Errorf("calculateContainerMemory() returned %v, expected 59.6875", percent)
+        }
+    })
+
+    test.Run("reclaimable-exceeds-usage", func(test *testing.T) {
+        stats := types.MemoryStats{Usage: 1024, Stats: map[string]uint64{"inactive_file": 4096}}
+
+        usage := memoryUsage(&stats, cgroupV2)
+        if usage != 1024 {
+            test.Errorf("memoryUsage() returned %d, expected 1024", usage)
+        }
+    })
+}
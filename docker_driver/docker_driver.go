@@ -21,13 +21,14 @@ import (
     "errors"
     "io"
     "io/ioutil"
-    "math"
     "strings"
+    "time"
 
     "github.com/docker/docker/api/types"
     "github.com/docker/docker/client"
     "golang.org/x/net/context"
     "github.com/docker/docker/api/types/container"
+    "github.com/docker/docker/api/types/filters"
     "github.com/docker/go-connections/nat"
 )
 
@@ -40,6 +41,21 @@ type DockerConfig struct {
     Cpu float64         // between 0.00 to 1.00*cores
     Network string
     Env []string
+    Labels map[string]string    // driver ownership labels are added on top
+    RestartPolicy RestartPolicy // default is no restart
+    HealthCheck *HealthCheck    // default is the image's HEALTHCHECK
+    StopSignal string           // default is the image's STOPSIGNAL, or SIGTERM
+    StopTimeout time.Duration   // rounded up to seconds, default is 10s
+    Resources Resources         // extended resource controls, default is none
+    Entrypoint []string         // default is the image's ENTRYPOINT
+    WorkingDir string           // default is the image's WORKDIR
+    User string                 // "user", "uid" or "uid:gid", default is the image's USER
+    Hostname string             // default is the container ID
+    Domainname string
+    OpenStdin bool              // keep stdin open, for ExecStream-style attach
+    Init bool                   // run an init process as PID 1 to reap zombies and forward signals
+    Tty *bool                   // default is true; false keeps stdout and stderr apart in logs
+    Security SecurityOptions    // default is the daemon's, see SecurityRestricted
 }
 
 // image should be imagename:version
@@ -94,6 +110,10 @@ func BuildImage(buildContext io.Reader, image string) error {
 
 // Pull image and return image digest
 func PullImage(image string) (digest string, err error) {
+    if err := admit(AdmissionRequest{Operation: OperationPull, Image: image}); err != nil {
+        return "", err
+    }
+
     ctx := context.Background()
     cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
     if err != nil {
@@ -238,6 +258,8 @@ func ListImages() ([]string, error) {
     return ilist, nil
 }
 
+// Note that the daemon counts paused containers as running
+// Use ListContainers(StateRunning) to leave them out
 func ListRunningContainers() ([]string, error) {
     ctx := context.Background()
     cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
@@ -259,6 +281,33 @@ func ListRunningContainers() ([]string, error) {
     return clist, nil
 }
 
+// List containers in any of the given states, or all containers if none are given
+func ListContainers(states ...string) ([]ContainerInfo, error) {
+    ctx := context.Background()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return nil, err
+    }
+    defer cli.Close()
+
+    args := filters.NewArgs()
+    for _, state := range states {
+        args.Add("status", state)
+    }
+
+    containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: args})
+    if err != nil {
+        return nil, err
+    }
+
+    var clist []ContainerInfo
+    for _, container := range containers {
+        clist = append(clist, containerInfoFromList(container))
+    }
+
+    return clist, nil
+}
+
 // following official stats_helper calculations
 func calculateContainerCPU(stats *types.Stats) (float64) {
     cpuPercent := 0.0
@@ -275,8 +324,8 @@ func calculateContainerCPU(stats *types.Stats) (float64) {
     return cpuPercent
 }
 
-func calculateContainerMemory(stats *types.MemoryStats) (float64) {
-    memUsage := float64(stats.Usage) - float64(stats.Stats["cache"])
+func calculateContainerMemory(stats *types.MemoryStats, cgroupVersion int) (float64) {
+    memUsage := float64(memoryUsage(stats, cgroupVersion))
     limit := float64(stats.Limit)
 
     if limit != 0 {
@@ -287,35 +336,50 @@ func calculateContainerMemory(stats *types.MemoryStats) (float64) {
 }
 
 // calculate container cpu and mem usage
+// Failures wrap ErrContainerNotFound, ErrContainerNotRunning, ErrEmptyStats or ErrStatsDecode
 func CheckContainerHealth(cont string) (float64, float64, error) {
+    metrics, err := GetContainerMetrics(cont)
+    if err != nil {
+        return 0, 0, err
+    }
+
+    return metrics.CPUPercent, metrics.MemoryPercent, nil
+}
+
+// stopping container
+func StopContainer(cont string) (string, error) {
     ctx := context.Background()
     cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
     if err != nil {
-        return 0, 0, err
+        return "", err
     }
     defer cli.Close()
 
-    resp, err := cli.ContainerStats(ctx, cont, false)
-    if err != nil {
-        return 0, 0, err
+    if err := cli.ContainerStop(ctx, cont, nil); err != nil {
+        return "", err
     }
 
-    var containerStats types.StatsJSON
-    decoder := json.NewDecoder(resp.Body)
-    decoder.Decode(&containerStats)
-    stats := containerStats.Stats
+    return "success", nil
+}
 
-    cpuPercent := calculateContainerCPU(&stats)
-    //fmt.Println("cpu", cpuPercent)
+// deleting container
+func DeleteContainer(cont string) (string, error) {
+    ctx := context.Background()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return "", err
+    }
+    defer cli.Close()
 
-    memPercent := calculateContainerMemory(&stats.MemoryStats)
-    //fmt.Println("mem", memPercent)
+    if err := cli.ContainerRemove(ctx, cont, types.ContainerRemoveOptions{}); err != nil {
+        return "", err
+    }
 
-    return cpuPercent, memPercent, nil
+    return "success", nil
 }
 
-// stopping container
-func StopContainer(cont string) (string, error) {
+// pausing container, freezes its processes but keeps its memory
+func PauseContainer(cont string) (string, error) {
     ctx := context.Background()
     cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
     if err != nil {
@@ -323,15 +387,15 @@ func StopContainer(cont string) (string, error) {
     }
     defer cli.Close()
 
-    if err := cli.ContainerStop(ctx, cont, nil); err != nil {
+    if err := cli.ContainerPause(ctx, cont); err != nil {
         return "", err
     }
 
     return "success", nil
 }
 
-// deleting container
-func DeleteContainer(cont string) (string, error) {
+// unpausing container
+func UnpauseContainer(cont string) (string, error) {
     ctx := context.Background()
     cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
     if err != nil {
@@ -339,7 +403,7 @@ func DeleteContainer(cont string) (string, error) {
     }
     defer cli.Close()
 
-    if err := cli.ContainerRemove(ctx, cont, types.ContainerRemoveOptions{}); err != nil {
+    if err := cli.ContainerUnpause(ctx, cont); err != nil {
         return "", err
     }
 
@@ -364,6 +428,13 @@ func RestartContainer(cont string) (string, error) {
 
 // resizing a container instance on the fly
 func ResizeContainer(cont string, mem int64, cpu float64) (string, error) {
+    return ResizeContainerWithResources(cont, mem, cpu, Resources{})
+}
+
+// create and run container - detached, interactive unless Tty is false
+// image (already pulled) should be imagename:version
+// default/empty cmd is the image's CMD
+func RunContainer(opt DockerConfig) (string, error) {
     ctx := context.Background()
     cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
     if err != nil {
@@ -371,23 +442,30 @@ func ResizeContainer(cont string, mem int64, cpu float64) (string, error) {
     }
     defer cli.Close()
 
-    _, err = cli.ContainerUpdate(ctx, cont, container.UpdateConfig{
-        Resources: container.Resources{
-            Memory: mem,
-            NanoCPUs: int64(cpu*(math.Pow(10, 9))),
-        },
-    });
+    contID, _, err := runContainer(ctx, cli, opt)
+    return contID, err
+}
+
+// Create a container without starting it
+// Returns its ID and any warnings the daemon raised about the config
+func CreateContainer(opt DockerConfig) (string, []string, error) {
+    ctx := context.Background()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
     if err != nil {
-        return "", err
+        return "", nil, err
     }
+    defer cli.Close()
 
-    return "success", nil
+    resp, err := createContainer(ctx, cli, opt, nil)
+    if err != nil {
+        return "", nil, err
+    }
+
+    return resp.ID, resp.Warnings, nil
 }
 
-// create and run container - interactive and detached set
-// image (already pulled) should be imagename:version
-// default/empty cmd is /bin/bash
-func RunContainer(opt DockerConfig) (string, error) {
+// Start a created (or stopped) container
+func StartContainer(cont string) (string, error) {
     ctx := context.Background()
     cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
     if err != nil {
@@ -395,31 +473,114 @@ func RunContainer(opt DockerConfig) (string, error) {
     }
     defer cli.Close()
 
-    resp, err := cli.ContainerCreate(ctx, &container.Config{
-        Image: opt.Image,
-        Cmd: opt.Cmd,
-        ExposedPorts: nat.PortSet{ nat.Port(opt.Port[0]) : struct{}{} },
-        Tty: true,
-        Env: opt.Env,
-    },
-    &container.HostConfig{
-        NetworkMode: container.NetworkMode(opt.Network),
-        PortBindings: nat.PortMap{ nat.Port(opt.Port[0]) :
-            []nat.PortBinding{ nat.PortBinding{ HostPort: opt.Port[1] } }, },
-        Resources: container.Resources{
-            Memory: opt.Memory,
-            NanoCPUs: int64(opt.Cpu*(math.Pow(10, 9))),
-        },
-    },
-    nil, opt.Name)
+    err = cli.ContainerStart(ctx, cont, types.ContainerStartOptions{})
     if err != nil {
         return "", err
     }
 
+    return "success", nil
+}
+
+// Create and start a container, removing it again if it fails to start
+func runContainer(ctx context.Context, cli *client.Client, opt DockerConfig) (string, []string, error) {
+    resp, err := createContainer(ctx, cli, opt, nil)
+    if err != nil {
+        return "", nil, err
+    }
+
     err = cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{})
     if err != nil {
-        return "", err
+        cli.ContainerRemove(ctx, resp.ID, types.ContainerRemoveOptions{Force: true})
+        return "", resp.Warnings, err
+    }
+
+    return resp.ID, resp.Warnings, nil
+}
+
+// Validate opt and create a container from it without starting it
+// extra labels are stamped on top of opt's, see containerLabels
+func createContainer(ctx context.Context, cli *client.Client, opt DockerConfig, extra map[string]string) (container.ContainerCreateCreatedBody, error) {
+    err := opt.validate(ctx, cli)
+    if err != nil {
+        return container.ContainerCreateCreatedBody{}, err
+    }
+
+    config, hostConfig, err := containerConfigs(opt, extra)
+    if err != nil {
+        return container.ContainerCreateCreatedBody{}, err
     }
 
-    return resp.ID, nil
+    // Admitted last, so the policy sees the host config as the daemon will
+    err = admitCreate(opt, hostConfig)
+    if err != nil {
+        return container.ContainerCreateCreatedBody{}, err
+    }
+
+    return cli.ContainerCreate(ctx, config, hostConfig, nil, opt.Name)
+}
+
+func admitCreate(opt DockerConfig, hostConfig *container.HostConfig) error {
+    return admit(AdmissionRequest{Operation: OperationCreate, Image: opt.Image, Config: &opt, HostConfig: hostConfig})
+}
+
+// The daemon's container and host configs for opt
+func containerConfigs(opt DockerConfig, extra map[string]string) (*container.Config, *container.HostConfig, error) {
+    labels, err := containerLabels(opt, extra)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    restartPolicy, err := opt.RestartPolicy.toDocker()
+    if err != nil {
+        return nil, nil, err
+    }
+
+    healthCheck, err := opt.HealthCheck.toDocker()
+    if err != nil {
+        return nil, nil, err
+    }
+
+    // Kept on by default, containers were always created with a TTY before it was configurable
+    tty := true
+    if opt.Tty != nil {
+        tty = *opt.Tty
+    }
+
+    // nil leaves it to the daemon's default, which is normally no init
+    var init *bool
+    if opt.Init {
+        init = &opt.Init
+    }
+
+    hostConfig := &container.HostConfig{
+        NetworkMode: container.NetworkMode(opt.Network),
+        RestartPolicy: restartPolicy,
+        PortBindings: nat.PortMap{ nat.Port(opt.Port[0]) :
+            []nat.PortBinding{ nat.PortBinding{ HostPort: opt.Port[1] } }, },
+        Resources: opt.Resources.toDocker(opt.Memory, opt.Cpu),
+        OomScoreAdj: opt.Resources.OomScoreAdj,
+        Init: init,
+    }
+    err = opt.Security.apply(hostConfig)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    return &container.Config{
+        Image: opt.Image,
+        Cmd: opt.Cmd,
+        Entrypoint: opt.Entrypoint,
+        WorkingDir: opt.WorkingDir,
+        User: opt.User,
+        Hostname: opt.Hostname,
+        Domainname: opt.Domainname,
+        OpenStdin: opt.OpenStdin,
+        ExposedPorts: nat.PortSet{ nat.Port(opt.Port[0]) : struct{}{} },
+        Tty: tty,
+        Env: opt.Env,
+        Labels: labels,
+        Healthcheck: healthCheck,
+        StopSignal: opt.StopSignal,
+        StopTimeout: stopTimeoutSeconds(opt.StopTimeout),
+    }, hostConfig, nil
 }
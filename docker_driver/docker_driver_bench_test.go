@@ -15,8 +15,10 @@
 package docker_driver_test
 
 import (
+    "context"
     "fmt"
     "testing"
+    "time"
 
     driver "github.com/PhysarumSM/docker-driver/docker_driver"
 )
@@ -60,3 +62,42 @@ func BenchmarkRunContainer(bench *testing.B) {
         }
     })
 }
+
+func BenchmarkPooledRunContainer(bench *testing.B) {
+    defer removeContainers()
+
+    for _, paused := range []bool{false, true} {
+        name := "Created"
+        if paused {
+            name = "Paused"
+        }
+
+        bench.Run(name, func(bench *testing.B) {
+            pool, err := driver.NewContainerPool(driver.PoolOptions{Size: 8, Paused: paused})
+            if err != nil {
+                bench.Fatalf("NewContainerPool() returned:\n%v", err)
+            }
+            defer pool.Close()
+
+            ctx, cancel := context.WithCancel(context.Background())
+            defer cancel()
+            go pool.Run(ctx)
+
+            // Fill the pool before timing, as a long-running service would have
+            pool.Prewarm(opt)
+            for pool.Len(opt) < 8 {
+                time.Sleep(10 * time.Millisecond)
+            }
+            bench.ResetTimer()
+
+            for i := 0; i < bench.N; i++ {
+                contID, err := pool.Acquire(opt)
+                if err != nil || contID == "" {
+                    bench.Errorf("Acquire() returned:\n%v", err)
+                    continue
+                }
+                containerIDs = append(containerIDs, contID)
+            }
+        })
+    }
+}
@@ -15,8 +15,15 @@
 package docker_driver_test
 
 import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
     "os"
+    "strings"
     "testing"
+    "time"
 
     driver "github.com/PhysarumSM/docker-driver/docker_driver"
 )
@@ -181,3 +188,850 @@ func TestDeleteContainer(test *testing.T) {
     }
 }
 
+
+func TestManagedContainers(test *testing.T) {
+    opt := driver.DockerConfig{
+        Name: "managed_test",
+        Image: "busybox",
+        Cmd: []string{"sleep", "300"},
+        Labels: map[string]string{"test": "managed"},
+    }
+
+    contID, err := driver.RunContainer(opt)
+    if err != nil || contID == "" {
+        test.Fatalf("RunContainer() returned:\n%v", err)
+    }
+
+    test.Run("ListManagedContainers", func(test *testing.T) {
+        clist, err := driver.ListManagedContainers()
+        if err != nil {
+            test.Errorf("ListManagedContainers() returned:\n%v", err)
+        }
+
+        found := false
+        for _, cont := range clist {
+            if cont == contID {
+                found = true
+            }
+        }
+        if !found {
+            test.Errorf("ListManagedContainers() did not return container (%s)", contID)
+        }
+    })
+
+    test.Run("RemoveOrphanContainers-known", func(test *testing.T) {
+        removed, err := driver.RemoveOrphanContainers([]string{opt.Name})
+        if err != nil {
+            test.Errorf("RemoveOrphanContainers() returned:\n%v", err)
+        }
+        for _, cont := range removed {
+            if cont == contID {
+                test.Errorf("RemoveOrphanContainers() removed known container (%s)", contID)
+            }
+        }
+    })
+
+    test.Run("RemoveOrphanContainers-orphan", func(test *testing.T) {
+        // Keep every other managed container on the host so only ours is swept
+        clist, err := driver.ListManagedContainers()
+        if err != nil {
+            test.Fatalf("ListManagedContainers() returned:\n%v", err)
+        }
+        var known []string
+        for _, cont := range clist {
+            if cont != contID {
+                known = append(known, cont)
+            }
+        }
+
+        removed, err := driver.RemoveOrphanContainers(known)
+        if err != nil {
+            test.Errorf("RemoveOrphanContainers() returned:\n%v", err)
+        }
+
+        found := false
+        for _, cont := range removed {
+            if cont == contID {
+                found = true
+            }
+        }
+        if !found {
+            test.Errorf("RemoveOrphanContainers() did not remove orphan container (%s)", contID)
+        }
+    })
+}
+
+func TestHealthCheck(test *testing.T) {
+    opt := driver.DockerConfig{
+        Name: "health_test",
+        Image: "busybox",
+        Cmd: []string{"sleep", "300"},
+        RestartPolicy: driver.RestartPolicy{Name: driver.RestartOnFailure, MaxRetries: 3},
+        HealthCheck: &driver.HealthCheck{
+            Cmd: []string{"true"},
+            Interval: time.Second,
+            Retries: 1,
+        },
+    }
+
+    contID, err := driver.RunContainer(opt)
+    if err != nil || contID == "" {
+        test.Fatalf("RunContainer() returned:\n%v", err)
+    }
+    defer func() {
+        driver.StopContainer(contID)
+        driver.DeleteContainer(contID)
+    }()
+
+    status := ""
+    for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+        status, err = driver.GetHealthStatus(contID)
+        if err != nil {
+            test.Fatalf("GetHealthStatus() returned:\n%v", err)
+        }
+        if status == driver.HealthHealthy {
+            break
+        }
+        time.Sleep(500 * time.Millisecond)
+    }
+    if status != driver.HealthHealthy {
+        test.Errorf("GetHealthStatus() returned %s, expected %s", status, driver.HealthHealthy)
+    }
+}
+
+func TestGetHealthStatus(test *testing.T) {
+    // Test failure case (success case covered in health check test)
+    _, err := driver.GetHealthStatus(failContID)
+    if err == nil {
+        test.Errorf("GetHealthStatus() succeeded with container (%s), expected it to fail", failContID)
+    }
+}
+
+func TestWaitContainer(test *testing.T) {
+    opt := driver.DockerConfig{
+        Image: "busybox",
+        Cmd: []string{"sh", "-c", "exit 3"},
+    }
+
+    contID, err := driver.RunContainer(opt)
+    if err != nil || contID == "" {
+        test.Fatalf("RunContainer() returned:\n%v", err)
+    }
+    defer driver.DeleteContainer(contID)
+
+    exitCode, err := driver.WaitContainer(contID, driver.WaitNotRunning, 30 * time.Second)
+    if err != nil {
+        test.Errorf("WaitContainer() returned:\n%v", err)
+    }
+    if exitCode != 3 {
+        test.Errorf("WaitContainer() returned exit code %d, expected 3", exitCode)
+    }
+}
+
+func TestWaitReady(test *testing.T) {
+    test.Run("WaitReady-success", func(test *testing.T) {
+        opt := driver.DockerConfig{
+            Image: "busybox",
+            Cmd: []string{"sleep", "300"},
+        }
+
+        contID, err := driver.RunContainer(opt)
+        if err != nil || contID == "" {
+            test.Fatalf("RunContainer() returned:\n%v", err)
+        }
+        defer func() {
+            driver.StopContainer(contID)
+            driver.DeleteContainer(contID)
+        }()
+
+        err = driver.WaitReady(contID, driver.ReadyOptions{Timeout: 10 * time.Second})
+        if err != nil {
+            test.Errorf("WaitReady() returned:\n%v", err)
+        }
+    })
+
+    test.Run("WaitReady-fail", func(test *testing.T) {
+        opt := driver.DockerConfig{
+            Image: "busybox",
+            Cmd: []string{"sh", "-c", "echo failing; exit 1"},
+        }
+
+        contID, err := driver.RunContainer(opt)
+        if err != nil || contID == "" {
+            test.Fatalf("RunContainer() returned:\n%v", err)
+        }
+        defer driver.DeleteContainer(contID)
+
+        driver.WaitContainer(contID, driver.WaitNotRunning, 30 * time.Second)
+        err = driver.WaitReady(contID, driver.ReadyOptions{Timeout: 10 * time.Second})
+        readyErr, ok := err.(*driver.ReadyError)
+        if !ok {
+            test.Fatalf("WaitReady() returned %v, expected a ReadyError", err)
+        }
+        if len(readyErr.Logs) == 0 {
+            test.Errorf("WaitReady() returned no log lines for failed container")
+        }
+    })
+}
+
+func TestLogs(test *testing.T) {
+    opt := driver.DockerConfig{
+        Image: "busybox",
+        Cmd: []string{"sh", "-c", "echo first; echo second; sleep 300"},
+    }
+
+    contID, err := driver.RunContainer(opt)
+    if err != nil || contID == "" {
+        test.Fatalf("RunContainer() returned:\n%v", err)
+    }
+    defer func() {
+        driver.StopContainer(contID)
+        driver.DeleteContainer(contID)
+    }()
+    time.Sleep(time.Second)
+
+    test.Run("GetLogs", func(test *testing.T) {
+        stdout, _, err := driver.GetLogs(contID, driver.LogOptions{Tail: 1})
+        if err != nil {
+            test.Errorf("GetLogs() returned:\n%v", err)
+        }
+        if strings.TrimSpace(stdout) != "second" {
+            test.Errorf("GetLogs() returned %q, expected last line only", stdout)
+        }
+    })
+
+    test.Run("FollowLogs", func(test *testing.T) {
+        ctx, cancel := context.WithTimeout(context.Background(), 2 * time.Second)
+        defer cancel()
+
+        var stdout, stderr bytes.Buffer
+        err := driver.FollowLogs(ctx, contID, driver.LogOptions{}, &stdout, &stderr)
+        if err != nil {
+            test.Errorf("FollowLogs() returned:\n%v", err)
+        }
+        if !strings.Contains(stdout.String(), "first") {
+            test.Errorf("FollowLogs() returned %q, expected it to contain output", stdout.String())
+        }
+    })
+}
+
+func TestGetLogs(test *testing.T) {
+    // Test failure case (success case covered in logs test)
+    _, _, err := driver.GetLogs(failContID, driver.LogOptions{})
+    if err == nil {
+        test.Errorf("GetLogs() succeeded with container (%s), expected it to fail", failContID)
+    }
+}
+
+func TestExec(test *testing.T) {
+    opt := driver.DockerConfig{
+        Image: "busybox",
+        Cmd: []string{"sleep", "300"},
+    }
+
+    contID, err := driver.RunContainer(opt)
+    if err != nil || contID == "" {
+        test.Fatalf("RunContainer() returned:\n%v", err)
+    }
+    defer func() {
+        driver.StopContainer(contID)
+        driver.DeleteContainer(contID)
+    }()
+
+    test.Run("Exec-success", func(test *testing.T) {
+        result, err := driver.Exec(contID, driver.ExecOptions{
+            Cmd: []string{"sh", "-c", "cat; echo $GREETING >&2; exit 2"},
+            Env: []string{"GREETING=hello"},
+            Stdin: strings.NewReader("input"),
+        })
+        if err != nil {
+            test.Fatalf("Exec() returned:\n%v", err)
+        }
+        if result.Stdout != "input" {
+            test.Errorf("Exec() returned stdout %q, expected %q", result.Stdout, "input")
+        }
+        if strings.TrimSpace(result.Stderr) != "hello" {
+            test.Errorf("Exec() returned stderr %q, expected %q", result.Stderr, "hello")
+        }
+        if result.ExitCode != 2 {
+            test.Errorf("Exec() returned exit code %d, expected 2", result.ExitCode)
+        }
+    })
+
+    test.Run("Exec-fail", func(test *testing.T) {
+        _, err := driver.Exec(failContID, driver.ExecOptions{Cmd: []string{"true"}})
+        if err == nil {
+            test.Errorf("Exec() succeeded with container (%s), expected it to fail", failContID)
+        }
+    })
+}
+
+func TestStreamContainerStats(test *testing.T) {
+    opt := driver.DockerConfig{
+        Image: "busybox",
+        Cmd: []string{"sleep", "300"},
+        Memory: 10e+6,
+    }
+
+    contID, err := driver.RunContainer(opt)
+    if err != nil || contID == "" {
+        test.Fatalf("RunContainer() returned:\n%v", err)
+    }
+    defer func() {
+        driver.StopContainer(contID)
+        driver.DeleteContainer(contID)
+    }()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    samples, errs := driver.StreamContainerStats(ctx, contID)
+
+    for i := 0; i < 2; i++ {
+        select {
+        case sample := <-samples:
+            if sample.MemoryLimit == 0 || sample.PIDs == 0 {
+                test.Errorf("StreamContainerStats() returned incomplete sample: %+v", sample)
+            }
+        case err := <-errs:
+            test.Fatalf("StreamContainerStats() returned:\n%v", err)
+        case <-time.After(10 * time.Second):
+            test.Fatalf("StreamContainerStats() timed out waiting for a sample")
+        }
+    }
+
+    // Cancelling must close both channels without reporting an error
+    cancel()
+    for range samples {
+    }
+    if err := <-errs; err != nil {
+        test.Errorf("StreamContainerStats() returned after cancel:\n%v", err)
+    }
+}
+
+func TestGetContainerMetrics(test *testing.T) {
+    test.Run("GetContainerMetrics-success", func(test *testing.T) {
+        opt := driver.DockerConfig{
+            Image: "busybox",
+            Cmd: []string{"sleep", "300"},
+            Memory: 10e+6,
+            Cpu: 0.5,
+        }
+
+        contID, err := driver.RunContainer(opt)
+        if err != nil || contID == "" {
+            test.Fatalf("RunContainer() returned:\n%v", err)
+        }
+        defer func() {
+            driver.StopContainer(contID)
+            driver.DeleteContainer(contID)
+        }()
+
+        metrics, err := driver.GetContainerMetrics(contID)
+        if err != nil {
+            test.Fatalf("GetContainerMetrics() returned:\n%v", err)
+        }
+        if metrics.MemoryUsage == 0 || metrics.MemoryLimit == 0 {
+            test.Errorf("GetContainerMetrics() returned no memory usage: %+v", metrics)
+        }
+        if metrics.MemoryLimit > uint64(opt.Memory) {
+            test.Errorf("GetContainerMetrics() returned memory limit %d, expected at most %d", metrics.MemoryLimit, int64(opt.Memory))
+        }
+        if metrics.PIDs == 0 {
+            test.Errorf("GetContainerMetrics() returned no PIDs: %+v", metrics)
+        }
+    })
+
+    test.Run("GetContainerMetrics-fail", func(test *testing.T) {
+        _, err := driver.GetContainerMetrics(failContID)
+        if err == nil {
+            test.Errorf("GetContainerMetrics() succeeded with container (%s), expected it to fail", failContID)
+        }
+    })
+}
+
+func TestGetExitReason(test *testing.T) {
+    test.Run("GetExitReason-error", func(test *testing.T) {
+        opt := driver.DockerConfig{
+            Image: "busybox",
+            Cmd: []string{"sh", "-c", "echo failing; exit 3"},
+        }
+
+        contID, err := driver.RunContainer(opt)
+        if err != nil || contID == "" {
+            test.Fatalf("RunContainer() returned:\n%v", err)
+        }
+        defer driver.DeleteContainer(contID)
+
+        driver.WaitContainer(contID, driver.WaitNotRunning, 30 * time.Second)
+        reason, err := driver.GetExitReason(contID, 0)
+        if err != nil {
+            test.Fatalf("GetExitReason() returned:\n%v", err)
+        }
+        if reason.Reason != driver.ExitError || reason.ExitCode != 3 {
+            test.Errorf("GetExitReason() returned %s with code %d, expected %s with code 3", reason.Reason, reason.ExitCode, driver.ExitError)
+        }
+        if len(reason.Logs) == 0 {
+            test.Errorf("GetExitReason() returned no log lines")
+        }
+    })
+
+    test.Run("GetExitReason-stopped", func(test *testing.T) {
+        opt := driver.DockerConfig{
+            Image: "busybox",
+            Cmd: []string{"sleep", "300"},
+        }
+
+        contID, err := driver.RunContainer(opt)
+        if err != nil || contID == "" {
+            test.Fatalf("RunContainer() returned:\n%v", err)
+        }
+        defer driver.DeleteContainer(contID)
+
+        _, err = driver.StopContainer(contID)
+        if err != nil {
+            test.Fatalf("StopContainer() returned:\n%v", err)
+        }
+        reason, err := driver.GetExitReason(contID, 0)
+        if err != nil {
+            test.Fatalf("GetExitReason() returned:\n%v", err)
+        }
+        if reason.Reason != driver.ExitStopped {
+            test.Errorf("GetExitReason() returned %s, expected %s", reason.Reason, driver.ExitStopped)
+        }
+    })
+
+    test.Run("GetExitReason-fail", func(test *testing.T) {
+        _, err := driver.GetExitReason(failContID, 0)
+        if err == nil {
+            test.Errorf("GetExitReason() succeeded with container (%s), expected it to fail", failContID)
+        }
+    })
+}
+
+func TestStopContainerWithOptions(test *testing.T) {
+    opt := driver.DockerConfig{
+        Image: "busybox",
+        Cmd: []string{"sleep", "300"},     // PID 1 ignores SIGTERM
+        StopSignal: "SIGTERM",
+        StopTimeout: time.Second,
+    }
+
+    contID, err := driver.RunContainer(opt)
+    if err != nil || contID == "" {
+        test.Fatalf("RunContainer() returned:\n%v", err)
+    }
+    defer driver.DeleteContainer(contID)
+
+    test.Run("StopContainerWithOptions-nokill", func(test *testing.T) {
+        _, err := driver.StopContainerWithOptions(contID, driver.StopOptions{Timeout: time.Second, NoKill: true})
+        if err == nil {
+            test.Errorf("StopContainerWithOptions() succeeded without SIGKILL, expected it to time out")
+        }
+    })
+
+    test.Run("StopContainerWithOptions-escalate", func(test *testing.T) {
+        start := time.Now()
+        _, err := driver.StopContainerWithOptions(contID, driver.StopOptions{Signal: "SIGINT"})
+        if err != nil {
+            test.Fatalf("StopContainerWithOptions() returned:\n%v", err)
+        }
+        // Container's StopTimeout of 1s applies since none was given
+        if elapsed := time.Since(start); elapsed > 5 * time.Second {
+            test.Errorf("StopContainerWithOptions() took %v, expected about 1s", elapsed)
+        }
+
+        reason, err := driver.GetExitReason(contID, 0)
+        if err != nil {
+            test.Fatalf("GetExitReason() returned:\n%v", err)
+        }
+        if reason.ExitCode != 137 {
+            test.Errorf("Container exited with code %d, expected 137 (SIGKILL)", reason.ExitCode)
+        }
+        if reason.Reason != driver.ExitStopped {
+            test.Errorf("GetExitReason() returned %s, expected %s", reason.Reason, driver.ExitStopped)
+        }
+    })
+
+    test.Run("RestartContainerWithOptions", func(test *testing.T) {
+        _, err := driver.RestartContainerWithOptions(contID, driver.StopOptions{Timeout: time.Second})
+        if err != nil {
+            test.Errorf("RestartContainerWithOptions() returned:\n%v", err)
+        }
+    })
+
+    test.Run("KillContainer", func(test *testing.T) {
+        _, err := driver.KillContainer(contID, "SIGKILL")
+        if err != nil {
+            test.Errorf("KillContainer() returned:\n%v", err)
+        }
+    })
+}
+
+func TestKillContainer(test *testing.T) {
+    // Test failure case (success case covered in stop with options test)
+    _, err := driver.KillContainer(failContID, "SIGKILL")
+    if err == nil {
+        test.Errorf("KillContainer() succeeded with container (%s), expected it to fail", failContID)
+    }
+}
+
+func TestPauseContainer(test *testing.T) {
+    opt := driver.DockerConfig{
+        Image: "busybox",
+        Cmd: []string{"sleep", "300"},
+    }
+
+    contID, err := driver.RunContainer(opt)
+    if err != nil || contID == "" {
+        test.Fatalf("RunContainer() returned:\n%v", err)
+    }
+    defer driver.DeleteContainer(contID)
+    defer driver.StopContainer(contID)
+
+    listed := func(states ...string) bool {
+        conts, err := driver.ListContainers(states...)
+        if err != nil {
+            test.Fatalf("ListContainers() returned:\n%v", err)
+        }
+        for _, cont := range conts {
+            if cont.ID == contID {
+                return true
+            }
+        }
+        return false
+    }
+
+    _, err = driver.PauseContainer(contID)
+    if err != nil {
+        test.Fatalf("PauseContainer() returned:\n%v", err)
+    }
+    if !listed(driver.StatePaused) {
+        test.Errorf("ListContainers(paused) did not list paused container %s", contID)
+    }
+    if listed(driver.StateRunning) {
+        test.Errorf("ListContainers(running) listed paused container %s", contID)
+    }
+
+    _, err = driver.UnpauseContainer(contID)
+    if err != nil {
+        test.Fatalf("UnpauseContainer() returned:\n%v", err)
+    }
+    if !listed(driver.StateRunning) {
+        test.Errorf("ListContainers(running) did not list unpaused container %s", contID)
+    }
+    if !listed() {
+        test.Errorf("ListContainers() did not list container %s", contID)
+    }
+
+    // Test failure cases
+    _, err = driver.PauseContainer(failContID)
+    if err == nil {
+        test.Errorf("PauseContainer() succeeded with container (%s), expected it to fail", failContID)
+    }
+    _, err = driver.UnpauseContainer(failContID)
+    if err == nil {
+        test.Errorf("UnpauseContainer() succeeded with container (%s), expected it to fail", failContID)
+    }
+}
+
+func TestContainerPool(test *testing.T) {
+    opt := driver.DockerConfig{
+        Image: "busybox",
+        Cmd: []string{"sleep", "300"},
+    }
+
+    for _, paused := range []bool{false, true} {
+        test.Run(fmt.Sprintf("paused=%v", paused), func(test *testing.T) {
+            pool, err := driver.NewContainerPool(driver.PoolOptions{Size: 2, Paused: paused, IdleTTL: 2 * time.Second})
+            if err != nil {
+                test.Fatalf("NewContainerPool() returned:\n%v", err)
+            }
+            defer pool.Close()
+
+            ctx, cancel := context.WithCancel(context.Background())
+            defer cancel()
+            go pool.Run(ctx)
+
+            pool.Prewarm(opt)
+            deadline := time.Now().Add(30 * time.Second)
+            for pool.Len(opt) < 2 && time.Now().Before(deadline) {
+                if err := pool.Err(); err != nil {
+                    test.Fatalf("Pool failed to create warm containers:\n%v", err)
+                }
+                time.Sleep(50 * time.Millisecond)
+            }
+            if n := pool.Len(opt); n != 2 {
+                test.Fatalf("Pool has %d warm containers, expected 2", n)
+            }
+
+            contID, err := pool.Acquire(opt)
+            if err != nil || contID == "" {
+                test.Fatalf("Acquire() returned:\n%v", err)
+            }
+            defer driver.DeleteContainer(contID)
+            defer driver.StopContainer(contID)
+
+            running, err := driver.ListContainers(driver.StateRunning)
+            if err != nil {
+                test.Fatalf("ListContainers() returned:\n%v", err)
+            }
+            found := false
+            for _, cont := range running {
+                found = found || cont.ID == contID
+            }
+            if !found {
+                test.Errorf("Acquired container %s is not running", contID)
+            }
+
+            // Left unused past the TTL, the warm containers are evicted
+            time.Sleep(4 * time.Second)
+            if n := pool.Len(opt); n != 0 {
+                test.Errorf("Pool has %d warm containers after IdleTTL, expected 0", n)
+            }
+        })
+    }
+
+    // Test failure case
+    pool, err := driver.NewContainerPool(driver.PoolOptions{})
+    if err == nil {
+        pool.Close()
+        test.Errorf("NewContainerPool() succeeded with size 0, expected it to fail")
+    }
+}
+
+func TestCreateContainer(test *testing.T) {
+    opt := driver.DockerConfig{
+        Image: "busybox",
+        Cmd: []string{"sleep", "300"},
+    }
+
+    contID, _, err := driver.CreateContainer(opt)
+    if err != nil || contID == "" {
+        test.Fatalf("CreateContainer() returned:\n%v", err)
+    }
+    defer driver.DeleteContainer(contID)
+    defer driver.StopContainer(contID)
+
+    created, err := driver.ListContainers(driver.StateCreated)
+    if err != nil {
+        test.Fatalf("ListContainers() returned:\n%v", err)
+    }
+    found := false
+    for _, cont := range created {
+        found = found || cont.ID == contID
+    }
+    if !found {
+        test.Errorf("CreateContainer() container %s is not in created state", contID)
+    }
+
+    _, err = driver.StartContainer(contID)
+    if err != nil {
+        test.Errorf("StartContainer() returned:\n%v", err)
+    }
+
+    // Test failure case
+    _, err = driver.StartContainer(failContID)
+    if err == nil {
+        test.Errorf("StartContainer() succeeded with container (%s), expected it to fail", failContID)
+    }
+}
+
+func TestRunContainerStartFailure(test *testing.T) {
+    daemon := newFakeDaemon(test)
+    defer daemon.close()
+
+    removed := make(chan string, 1)
+    daemon.handle("/containers/create", func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusCreated)
+        w.Write([]byte(`{"Id": "nostart", "Warnings": ["Your kernel does not support swap limit capabilities"]}`))
+    })
+    daemon.handle("/containers/nostart/start", func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusInternalServerError)
+        w.Write([]byte(`{"message": "executable file not found in $PATH"}`))
+    })
+    daemon.handle("/containers/nostart", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == http.MethodDelete {
+            removed <- r.URL.Query().Get("force")
+        }
+        w.WriteHeader(http.StatusNoContent)
+    })
+
+    _, warnings, err := driver.CreateContainer(driver.DockerConfig{Image: "busybox"})
+    if err != nil {
+        test.Fatalf("CreateContainer() returned:\n%v", err)
+    }
+    if len(warnings) != 1 {
+        test.Errorf("CreateContainer() returned warnings %v, expected the daemon's one", warnings)
+    }
+
+    _, err = driver.RunContainer(driver.DockerConfig{Image: "busybox"})
+    if err == nil {
+        test.Fatalf("RunContainer() succeeded, expected the start to fail")
+    }
+    select {
+    case force := <-removed:
+        if force != "1" {
+            test.Errorf("Created container removed with force=%q, expected force", force)
+        }
+    default:
+        test.Errorf("RunContainer() did not remove the container that failed to start")
+    }
+}
+
+func TestResizeContainerWithResources(test *testing.T) {
+    opt := driver.DockerConfig{
+        Image: "busybox",
+        Cmd: []string{"sleep", "300"},
+        Memory: 64e+6,
+        Resources: driver.Resources{
+            MemoryReservation: 32e+6,
+            CPUShares: 512,
+            PidsLimit: 64,
+            OomScoreAdj: 100,
+            Ulimits: []driver.Ulimit{{Name: "nofile", Soft: 1024, Hard: 2048}},
+        },
+    }
+
+    contID, err := driver.RunContainer(opt)
+    if err != nil || contID == "" {
+        test.Fatalf("RunContainer() returned:\n%v", err)
+    }
+    defer driver.DeleteContainer(contID)
+    defer driver.StopContainer(contID)
+
+    _, err = driver.ResizeContainerWithResources(contID, 0, 0, driver.Resources{CPUShares: 1024, PidsLimit: 128})
+    if err != nil {
+        test.Errorf("ResizeContainerWithResources() returned:\n%v", err)
+    }
+
+    // Test failure cases
+    _, err = driver.ResizeContainerWithResources(contID, 0, 0, driver.Resources{OomScoreAdj: 200})
+    if err == nil {
+        test.Errorf("ResizeContainerWithResources() succeeded changing OOM score adjust, expected it to fail")
+    }
+    _, err = driver.ResizeContainerWithResources(failContID, 0, 0, driver.Resources{CPUShares: 1024})
+    if err == nil {
+        test.Errorf("ResizeContainerWithResources() succeeded with container (%s), expected it to fail", failContID)
+    }
+}
+
+func TestRunContainerProcessOptions(test *testing.T) {
+    // Built by TestBuildImage, a scratch image with nothing but /test
+    opt := driver.DockerConfig{
+        Image: "test-image",
+        Entrypoint: []string{"/test"},
+        WorkingDir: "/",
+        User: "65534",
+        Hostname: "builder",
+        Init: true,
+        Tty: new(bool),
+    }
+
+    contID, err := driver.RunContainer(opt)
+    if err != nil || contID == "" {
+        test.Fatalf("RunContainer() returned:\n%v", err)
+    }
+    defer driver.DeleteContainer(contID)
+
+    exitCode, err := driver.WaitContainer(contID, driver.WaitNotRunning, 30 * time.Second)
+    if err != nil || exitCode != 0 {
+        test.Fatalf("WaitContainer() returned %d, %v, expected a clean exit", exitCode, err)
+    }
+
+    // Without a TTY the streams stay apart
+    stdout, stderr, err := driver.GetLogs(contID, driver.LogOptions{})
+    if err != nil {
+        test.Fatalf("GetLogs() returned:\n%v", err)
+    }
+    if stdout != "Testing docker build\n" || stderr != "" {
+        test.Errorf("GetLogs() returned stdout %q and stderr %q, expected only the test output on stdout", stdout, stderr)
+    }
+}
+
+func TestCreateContainerProcessOptions(test *testing.T) {
+    daemon := newFakeDaemon(test)
+    defer daemon.close()
+
+    var body struct {
+        Entrypoint []string
+        WorkingDir string
+        User string
+        Hostname string
+        Domainname string
+        OpenStdin bool
+        Tty bool
+        HostConfig struct {
+            Init *bool
+        }
+    }
+    daemon.handle("/containers/create", func(w http.ResponseWriter, r *http.Request) {
+        json.NewDecoder(r.Body).Decode(&body)
+        w.WriteHeader(http.StatusCreated)
+        w.Write([]byte(`{"Id": "abc"}`))
+    })
+
+    // Defaults keep the TTY on and leave init to the daemon
+    _, _, err := driver.CreateContainer(driver.DockerConfig{Image: "busybox"})
+    if err != nil {
+        test.Fatalf("CreateContainer() returned:\n%v", err)
+    }
+    if !body.Tty || body.HostConfig.Init != nil {
+        test.Errorf("CreateContainer() sent Tty %v and Init %v, expected a TTY and no init", body.Tty, body.HostConfig.Init)
+    }
+
+    _, _, err = driver.CreateContainer(driver.DockerConfig{
+        Image: "busybox",
+        Entrypoint: []string{"/bin/sh", "-c"},
+        WorkingDir: "/tmp",
+        User: "nobody",
+        Hostname: "web",
+        Domainname: "example.com",
+        OpenStdin: true,
+        Init: true,
+        Tty: new(bool),
+    })
+    if err != nil {
+        test.Fatalf("CreateContainer() returned:\n%v", err)
+    }
+    if len(body.Entrypoint) != 2 || body.WorkingDir != "/tmp" || body.User != "nobody" ||
+        body.Hostname != "web" || body.Domainname != "example.com" || !body.OpenStdin {
+        test.Errorf("CreateContainer() sent %+v, expected the process options", body)
+    }
+    if body.Tty || body.HostConfig.Init == nil || !*body.HostConfig.Init {
+        test.Errorf("CreateContainer() sent Tty %v and Init %v, expected no TTY and an init", body.Tty, body.HostConfig.Init)
+    }
+}
+
+func TestRunContainerRestricted(test *testing.T) {
+    opt := driver.DockerConfig{
+        Image: "busybox",
+        Cmd: []string{"sleep", "300"},
+        Security: driver.SecurityOptions{Preset: driver.SecurityRestricted},
+    }
+
+    contID, err := driver.RunContainer(opt)
+    if err != nil || contID == "" {
+        test.Fatalf("RunContainer() returned:\n%v", err)
+    }
+    defer driver.DeleteContainer(contID)
+    defer driver.StopContainer(contID)
+
+    result, err := driver.Exec(contID, driver.ExecOptions{Cmd: []string{"touch", "/file"}})
+    if err != nil {
+        test.Fatalf("Exec() returned:\n%v", err)
+    }
+    if result.ExitCode == 0 {
+        test.Errorf("Writing to the root filesystem succeeded, expected it to be read-only")
+    }
+
+    result, err = driver.Exec(contID, driver.ExecOptions{Cmd: []string{"touch", "/tmp/file"}})
+    if err != nil || result.ExitCode != 0 {
+        test.Errorf("Writing to /tmp returned %+v, %v, expected the tmpfs to be writable", result, err)
+    }
+
+    // Test failure case
+    opt.Security = driver.SecurityOptions{CapAdd: []string{"ALL"}}
+    _, err = driver.RunContainer(opt)
+    if err == nil {
+        test.Errorf("RunContainer() succeeded adding ALL capabilities, expected it to fail")
+    }
+}
@@ -0,0 +1,476 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "io"
+    "reflect"
+    "strings"
+    "time"
+
+    "gopkg.in/yaml.v2"
+)
+
+// apiVersion of the current config file format
+const ConfigAPIVersion = "docker-driver.physarumsm/v1"
+
+// Config files written before apiVersion existed: DockerConfig's field
+// names as-is, Port as a two element array and durations in nanoseconds
+// JSON only, YAML was never supported for them
+const configAPIVersionLegacy = ""
+
+// Wire format of ConfigAPIVersion
+// Fields may be added to it, but never renamed or given a new meaning;
+// that needs a new apiVersion and a migration from this one
+type configV1 struct {
+    APIVersion string                   `json:"apiVersion" yaml:"apiVersion"`
+    Name string                         `json:"name,omitempty" yaml:"name,omitempty"`
+    Image string                        `json:"image" yaml:"image"`
+    Port *portV1                        `json:"port,omitempty" yaml:"port,omitempty"`
+    Cmd []string                        `json:"cmd,omitempty" yaml:"cmd,omitempty"`
+    Memory MemorySize                   `json:"memory,omitempty" yaml:"memory,omitempty"`
+    Cpu CPUs                            `json:"cpu,omitempty" yaml:"cpu,omitempty"`
+    Network string                      `json:"network,omitempty" yaml:"network,omitempty"`
+    Env []string                        `json:"env,omitempty" yaml:"env,omitempty"`
+    Labels map[string]string            `json:"labels,omitempty" yaml:"labels,omitempty"`
+    RestartPolicy *restartPolicyV1      `json:"restartPolicy,omitempty" yaml:"restartPolicy,omitempty"`
+    HealthCheck *healthCheckV1          `json:"healthCheck,omitempty" yaml:"healthCheck,omitempty"`
+    StopSignal string                   `json:"stopSignal,omitempty" yaml:"stopSignal,omitempty"`
+    StopTimeout duration                `json:"stopTimeout,omitempty" yaml:"stopTimeout,omitempty"`
+    Resources *resourcesV1              `json:"resources,omitempty" yaml:"resources,omitempty"`
+    Entrypoint []string                 `json:"entrypoint,omitempty" yaml:"entrypoint,omitempty"`
+    WorkingDir string                   `json:"workingDir,omitempty" yaml:"workingDir,omitempty"`
+    User string                         `json:"user,omitempty" yaml:"user,omitempty"`
+    Hostname string                     `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+    Domainname string                   `json:"domainname,omitempty" yaml:"domainname,omitempty"`
+    OpenStdin bool                      `json:"openStdin,omitempty" yaml:"openStdin,omitempty"`
+    Init bool                           `json:"init,omitempty" yaml:"init,omitempty"`
+    Tty *bool                           `json:"tty,omitempty" yaml:"tty,omitempty"`
+    Security *securityV1                `json:"security,omitempty" yaml:"security,omitempty"`
+}
+
+type securityV1 struct {
+    Preset string                       `json:"preset,omitempty" yaml:"preset,omitempty"`
+    CapAdd []string                     `json:"capAdd,omitempty" yaml:"capAdd,omitempty"`
+    CapDrop []string                    `json:"capDrop,omitempty" yaml:"capDrop,omitempty"`
+    ReadOnlyRootfs bool                 `json:"readOnlyRootfs,omitempty" yaml:"readOnlyRootfs,omitempty"`
+    NoNewPrivileges bool                `json:"noNewPrivileges,omitempty" yaml:"noNewPrivileges,omitempty"`
+    SeccompProfile string               `json:"seccompProfile,omitempty" yaml:"seccompProfile,omitempty"`
+    AppArmorProfile string              `json:"appArmorProfile,omitempty" yaml:"appArmorProfile,omitempty"`
+    UsernsMode string                   `json:"usernsMode,omitempty" yaml:"usernsMode,omitempty"`
+    MaskedPaths []string                `json:"maskedPaths,omitempty" yaml:"maskedPaths,omitempty"`
+    ReadonlyPaths []string              `json:"readonlyPaths,omitempty" yaml:"readonlyPaths,omitempty"`
+}
+
+type portV1 struct {
+    Container string      `json:"container" yaml:"container"`
+    Host string           `json:"host,omitempty" yaml:"host,omitempty"`
+}
+
+type restartPolicyV1 struct {
+    Name string           `json:"name" yaml:"name"`
+    MaxRetries int        `json:"maxRetries,omitempty" yaml:"maxRetries,omitempty"`
+}
+
+type healthCheckV1 struct {
+    Cmd []string          `json:"cmd" yaml:"cmd"`
+    Interval duration     `json:"interval,omitempty" yaml:"interval,omitempty"`
+    Timeout duration      `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+    StartPeriod duration  `json:"startPeriod,omitempty" yaml:"startPeriod,omitempty"`
+    Retries int           `json:"retries,omitempty" yaml:"retries,omitempty"`
+}
+
+type resourcesV1 struct {
+    MemoryReservation MemorySize        `json:"memoryReservation,omitempty" yaml:"memoryReservation,omitempty"`
+    MemorySwap MemorySize               `json:"memorySwap,omitempty" yaml:"memorySwap,omitempty"`
+    CPUShares int64                     `json:"cpuShares,omitempty" yaml:"cpuShares,omitempty"`
+    CpusetCpus string                   `json:"cpusetCpus,omitempty" yaml:"cpusetCpus,omitempty"`
+    CpusetMems string                   `json:"cpusetMems,omitempty" yaml:"cpusetMems,omitempty"`
+    CPUPeriod int64                     `json:"cpuPeriod,omitempty" yaml:"cpuPeriod,omitempty"`
+    CPUQuota int64                      `json:"cpuQuota,omitempty" yaml:"cpuQuota,omitempty"`
+    PidsLimit int64                     `json:"pidsLimit,omitempty" yaml:"pidsLimit,omitempty"`
+    BlkioWeight uint16                  `json:"blkioWeight,omitempty" yaml:"blkioWeight,omitempty"`
+    DeviceReadBps []throttleDeviceV1    `json:"deviceReadBps,omitempty" yaml:"deviceReadBps,omitempty"`
+    DeviceWriteBps []throttleDeviceV1   `json:"deviceWriteBps,omitempty" yaml:"deviceWriteBps,omitempty"`
+    DeviceReadIOps []throttleDeviceV1   `json:"deviceReadIOps,omitempty" yaml:"deviceReadIOps,omitempty"`
+    DeviceWriteIOps []throttleDeviceV1  `json:"deviceWriteIOps,omitempty" yaml:"deviceWriteIOps,omitempty"`
+    OomScoreAdj int                     `json:"oomScoreAdj,omitempty" yaml:"oomScoreAdj,omitempty"`
+    Ulimits []ulimitV1                  `json:"ulimits,omitempty" yaml:"ulimits,omitempty"`
+}
+
+type throttleDeviceV1 struct {
+    Path string           `json:"path" yaml:"path"`
+    Rate uint64           `json:"rate" yaml:"rate"`
+}
+
+type ulimitV1 struct {
+    Name string           `json:"name" yaml:"name"`
+    Soft int64            `json:"soft" yaml:"soft"`
+    Hard int64            `json:"hard" yaml:"hard"`
+}
+
+// Duration written as text, e.g. "1m30s"
+type duration time.Duration
+
+func (d duration) MarshalText() ([]byte, error) {
+    return []byte(time.Duration(d).String()), nil
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+    parsed, err := time.ParseDuration(string(text))
+    if err != nil {
+        return errors.New("docker_driver: Error invalid duration " + string(text))
+    }
+    *d = duration(parsed)
+    return nil
+}
+
+func toThrottleDevicesV1(devices []ThrottleDevice) []throttleDeviceV1 {
+    var converted []throttleDeviceV1
+    for _, device := range devices {
+        converted = append(converted, throttleDeviceV1{Path: device.Path, Rate: device.Rate})
+    }
+    return converted
+}
+
+func fromThrottleDevicesV1(devices []throttleDeviceV1) []ThrottleDevice {
+    var converted []ThrottleDevice
+    for _, device := range devices {
+        converted = append(converted, ThrottleDevice{Path: device.Path, Rate: device.Rate})
+    }
+    return converted
+}
+
+func toConfigV1(opt DockerConfig) configV1 {
+    v1 := configV1{
+        APIVersion: ConfigAPIVersion,
+        Name: opt.Name,
+        Image: opt.Image,
+        Cmd: opt.Cmd,
+        Memory: MemorySize(opt.Memory),
+        Cpu: CPUs(opt.Cpu),
+        Network: opt.Network,
+        Env: opt.Env,
+        Labels: opt.Labels,
+        StopSignal: opt.StopSignal,
+        StopTimeout: duration(opt.StopTimeout),
+        Entrypoint: opt.Entrypoint,
+        WorkingDir: opt.WorkingDir,
+        User: opt.User,
+        Hostname: opt.Hostname,
+        Domainname: opt.Domainname,
+        OpenStdin: opt.OpenStdin,
+        Init: opt.Init,
+        Tty: opt.Tty,
+    }
+    if opt.Port != [2]string{} {
+        v1.Port = &portV1{Container: opt.Port[0], Host: opt.Port[1]}
+    }
+    if opt.RestartPolicy != (RestartPolicy{}) {
+        v1.RestartPolicy = &restartPolicyV1{Name: opt.RestartPolicy.Name, MaxRetries: opt.RestartPolicy.MaxRetries}
+    }
+    if check := opt.HealthCheck; check != nil {
+        // Empty Cmd disables the image's check, write it as [] since null is not an array
+        cmd := check.Cmd
+        if cmd == nil {
+            cmd = []string{}
+        }
+        v1.HealthCheck = &healthCheckV1{
+            Cmd: cmd,
+            Interval: duration(check.Interval),
+            Timeout: duration(check.Timeout),
+            StartPeriod: duration(check.StartPeriod),
+            Retries: check.Retries,
+        }
+    }
+    if sec := opt.Security; !reflect.DeepEqual(sec, SecurityOptions{}) {
+        v1.Security = &securityV1{
+            Preset: sec.Preset,
+            CapAdd: sec.CapAdd,
+            CapDrop: sec.CapDrop,
+            ReadOnlyRootfs: sec.ReadOnlyRootfs,
+            NoNewPrivileges: sec.NoNewPrivileges,
+            SeccompProfile: sec.SeccompProfile,
+            AppArmorProfile: sec.AppArmorProfile,
+            UsernsMode: sec.UsernsMode,
+            MaskedPaths: sec.MaskedPaths,
+            ReadonlyPaths: sec.ReadonlyPaths,
+        }
+    }
+    if res := opt.Resources; !reflect.DeepEqual(res, Resources{}) {
+        v1.Resources = &resourcesV1{
+            MemoryReservation: MemorySize(res.MemoryReservation),
+            MemorySwap: MemorySize(res.MemorySwap),
+            CPUShares: res.CPUShares,
+            CpusetCpus: res.CpusetCpus,
+            CpusetMems: res.CpusetMems,
+            CPUPeriod: res.CPUPeriod,
+            CPUQuota: res.CPUQuota,
+            PidsLimit: res.PidsLimit,
+            BlkioWeight: res.BlkioWeight,
+            DeviceReadBps: toThrottleDevicesV1(res.DeviceReadBps),
+            DeviceWriteBps: toThrottleDevicesV1(res.DeviceWriteBps),
+            DeviceReadIOps: toThrottleDevicesV1(res.DeviceReadIOps),
+            DeviceWriteIOps: toThrottleDevicesV1(res.DeviceWriteIOps),
+            OomScoreAdj: res.OomScoreAdj,
+        }
+        for _, ulimit := range res.Ulimits {
+            v1.Resources.Ulimits = append(v1.Resources.Ulimits, ulimitV1{Name: ulimit.Name, Soft: ulimit.Soft, Hard: ulimit.Hard})
+        }
+    }
+    return v1
+}
+
+func (v1 configV1) toConfig() DockerConfig {
+    opt := DockerConfig{
+        Name: v1.Name,
+        Image: v1.Image,
+        Cmd: v1.Cmd,
+        Memory: int64(v1.Memory),
+        Cpu: float64(v1.Cpu),
+        Network: v1.Network,
+        Env: v1.Env,
+        Labels: v1.Labels,
+        StopSignal: v1.StopSignal,
+        StopTimeout: time.Duration(v1.StopTimeout),
+        Entrypoint: v1.Entrypoint,
+        WorkingDir: v1.WorkingDir,
+        User: v1.User,
+        Hostname: v1.Hostname,
+        Domainname: v1.Domainname,
+        OpenStdin: v1.OpenStdin,
+        Init: v1.Init,
+        Tty: v1.Tty,
+    }
+    if v1.Port != nil {
+        opt.Port = [2]string{v1.Port.Container, v1.Port.Host}
+    }
+    if v1.RestartPolicy != nil {
+        opt.RestartPolicy = RestartPolicy{Name: v1.RestartPolicy.Name, MaxRetries: v1.RestartPolicy.MaxRetries}
+    }
+    if check := v1.HealthCheck; check != nil {
+        var cmd []string
+        if len(check.Cmd) > 0 {
+            cmd = check.Cmd
+        }
+        opt.HealthCheck = &HealthCheck{
+            Cmd: cmd,
+            Interval: time.Duration(check.Interval),
+            Timeout: time.Duration(check.Timeout),
+            StartPeriod: time.Duration(check.StartPeriod),
+            Retries: check.Retries,
+        }
+    }
+    if sec := v1.Security; sec != nil {
+        opt.Security = SecurityOptions{
+            Preset: sec.Preset,
+            CapAdd: sec.CapAdd,
+            CapDrop: sec.CapDrop,
+            ReadOnlyRootfs: sec.ReadOnlyRootfs,
+            NoNewPrivileges: sec.NoNewPrivileges,
+            SeccompProfile: sec.SeccompProfile,
+            AppArmorProfile: sec.AppArmorProfile,
+            UsernsMode: sec.UsernsMode,
+            MaskedPaths: sec.MaskedPaths,
+            ReadonlyPaths: sec.ReadonlyPaths,
+        }
+    }
+    if res := v1.Resources; res != nil {
+        opt.Resources = Resources{
+            MemoryReservation: int64(res.MemoryReservation),
+            MemorySwap: int64(res.MemorySwap),
+            CPUShares: res.CPUShares,
+            CpusetCpus: res.CpusetCpus,
+            CpusetMems: res.CpusetMems,
+            CPUPeriod: res.CPUPeriod,
+            CPUQuota: res.CPUQuota,
+            PidsLimit: res.PidsLimit,
+            BlkioWeight: res.BlkioWeight,
+            DeviceReadBps: fromThrottleDevicesV1(res.DeviceReadBps),
+            DeviceWriteBps: fromThrottleDevicesV1(res.DeviceWriteBps),
+            DeviceReadIOps: fromThrottleDevicesV1(res.DeviceReadIOps),
+            DeviceWriteIOps: fromThrottleDevicesV1(res.DeviceWriteIOps),
+            OomScoreAdj: res.OomScoreAdj,
+        }
+        for _, ulimit := range res.Ulimits {
+            opt.Resources.Ulimits = append(opt.Resources.Ulimits, Ulimit{Name: ulimit.Name, Soft: ulimit.Soft, Hard: ulimit.Hard})
+        }
+    }
+    return opt
+}
+
+// Encode opt as JSON in the current config file format
+func MarshalConfigJSON(opt DockerConfig) ([]byte, error) {
+    return json.MarshalIndent(toConfigV1(opt), "", "  ")
+}
+
+// Encode opt as YAML in the current config file format
+func MarshalConfigYAML(opt DockerConfig) ([]byte, error) {
+    return yaml.Marshal(toConfigV1(opt))
+}
+
+// Decode a JSON config file, migrating it from older formats if needed
+// Unknown fields and unknown apiVersions are errors, so typos are not silently dropped
+func UnmarshalConfigJSON(data []byte) (DockerConfig, error) {
+    var header struct {
+        APIVersion string `json:"apiVersion"`
+    }
+    if err := json.Unmarshal(data, &header); err != nil {
+        return DockerConfig{}, err
+    }
+
+    switch header.APIVersion {
+    case ConfigAPIVersion:
+        var v1 configV1
+        if err := decodeJSONStrict(data, &v1); err != nil {
+            return DockerConfig{}, err
+        }
+        return v1.toConfig(), nil
+    case configAPIVersionLegacy:
+        return migrateLegacyConfig(data)
+    }
+    return DockerConfig{}, errors.New("docker_driver: Error unknown config apiVersion " + header.APIVersion)
+}
+
+// Decode a YAML config file
+// Unknown fields and unknown apiVersions are errors, so typos are not silently dropped
+func UnmarshalConfigYAML(data []byte) (DockerConfig, error) {
+    var header struct {
+        APIVersion string `yaml:"apiVersion"`
+    }
+    if err := yaml.Unmarshal(data, &header); err != nil {
+        return DockerConfig{}, err
+    }
+
+    switch header.APIVersion {
+    case ConfigAPIVersion:
+        var v1 configV1
+        if err := yaml.UnmarshalStrict(data, &v1); err != nil {
+            return DockerConfig{}, err
+        }
+        return v1.toConfig(), nil
+    case configAPIVersionLegacy:
+        return DockerConfig{}, errors.New("docker_driver: Error YAML config is missing apiVersion")
+    }
+    return DockerConfig{}, errors.New("docker_driver: Error unknown config apiVersion " + header.APIVersion)
+}
+
+// Legacy files are DockerConfig as encoding/json wrote it
+func migrateLegacyConfig(data []byte) (DockerConfig, error) {
+    type plain DockerConfig
+    var opt DockerConfig
+    legacy := struct {
+        *plain
+        Memory MemorySize
+        Cpu CPUs
+    }{plain: (*plain)(&opt)}
+
+    if err := decodeJSONStrict(data, &legacy); err != nil {
+        return DockerConfig{}, err
+    }
+
+    opt.Memory = int64(legacy.Memory)
+    opt.Cpu = float64(legacy.Cpu)
+    return opt, nil
+}
+
+// Decode exactly one JSON value, rejecting unknown fields
+func decodeJSONStrict(data []byte, v interface{}) error {
+    decoder := json.NewDecoder(bytes.NewReader(data))
+    decoder.DisallowUnknownFields()
+    if err := decoder.Decode(v); err != nil {
+        return err
+    }
+    if _, err := decoder.Token(); err != io.EOF {
+        return errors.New("docker_driver: Error unexpected data after config")
+    }
+    return nil
+}
+
+// Schemas of the wire types that are written as text
+var textSchemas = map[reflect.Type]map[string]interface{}{
+    reflect.TypeOf(MemorySize(0)): {
+        "oneOf": []interface{}{
+            map[string]interface{}{"type": "integer", "minimum": -1},
+            map[string]interface{}{"type": "string", "pattern": `^\s*(-1|\d+(\.\d+)* ?[kKmMgGtTpP]?[iI]?[bB]?)\s*$`},
+        },
+    },
+    reflect.TypeOf(CPUs(0)): {
+        "oneOf": []interface{}{
+            map[string]interface{}{"type": "number", "minimum": 0},
+            map[string]interface{}{"type": "string", "pattern": `^\s*\d+(\.\d+)?m?\s*$`},
+        },
+    },
+    reflect.TypeOf(duration(0)): {
+        "type": "string",
+        "pattern": `^(0|([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+)$`,
+    },
+}
+
+// JSON Schema (draft-07) of the current config file format, for editors and CI
+// Describes JSON and YAML files alike
+func ConfigJSONSchema() ([]byte, error) {
+    schema := typeSchema(reflect.TypeOf(configV1{}))
+    schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+    schema["title"] = "DockerConfig"
+    schema["properties"].(map[string]interface{})["apiVersion"] = map[string]interface{}{"const": ConfigAPIVersion}
+    return json.MarshalIndent(schema, "", "  ")
+}
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+    if schema, ok := textSchemas[t]; ok {
+        return schema
+    }
+
+    switch t.Kind() {
+    case reflect.Ptr:
+        return typeSchema(t.Elem())
+    case reflect.String:
+        return map[string]interface{}{"type": "string"}
+    case reflect.Bool:
+        return map[string]interface{}{"type": "boolean"}
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return map[string]interface{}{"type": "integer"}
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return map[string]interface{}{"type": "integer", "minimum": 0}
+    case reflect.Float32, reflect.Float64:
+        return map[string]interface{}{"type": "number"}
+    case reflect.Slice:
+        return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+    case reflect.Map:
+        return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+    case reflect.Struct:
+        properties := make(map[string]interface{})
+        required := []string{}
+        for i := 0; i < t.NumField(); i++ {
+            field := t.Field(i)
+            tag := strings.Split(field.Tag.Get("json"), ",")
+            properties[tag[0]] = typeSchema(field.Type)
+            if len(tag) == 1 {
+                required = append(required, tag[0])
+            }
+        }
+        return map[string]interface{}{
+            "type": "object",
+            "properties": properties,
+            "required": required,
+            "additionalProperties": false,
+        }
+    }
+    return map[string]interface{}{}
+}
@@ -0,0 +1,252 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver_test
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+
+    driver "github.com/PhysarumSM/docker-driver/docker_driver"
+)
+
+var encodedConfig = driver.DockerConfig{
+    Name: "web",
+    Image: "nginx:1.19",
+    Port: [2]string{"80/tcp", "8080"},
+    Memory: 512 << 20,
+    Cpu: 0.75,
+    Env: []string{"MODE=production"},
+    Labels: map[string]string{"app": "web"},
+    RestartPolicy: driver.RestartPolicy{Name: driver.RestartOnFailure, MaxRetries: 3},
+    HealthCheck: &driver.HealthCheck{
+        Cmd: []string{"curl", "-f", "http://localhost/"},
+        Interval: 30 * time.Second,
+        Retries: 3,
+    },
+    StopTimeout: 20 * time.Second,
+    Resources: driver.Resources{
+        MemorySwap: -1,
+        PidsLimit: 100,
+        Ulimits: []driver.Ulimit{{Name: "nofile", Soft: 1024, Hard: 2048}},
+    },
+    Entrypoint: []string{"/docker-entrypoint.sh"},
+    WorkingDir: "/srv",
+    User: "101:101",
+    Init: true,
+    Tty: new(bool),
+    Security: driver.SecurityOptions{
+        Preset: driver.SecurityRestricted,
+        CapAdd: []string{"NET_BIND_SERVICE"},
+    },
+}
+
+func TestUnmarshalConfigYAML(test *testing.T) {
+    data, err := ioutil.ReadFile("testdata/config_v1.yaml")
+    if err != nil {
+        test.Fatalf("ReadFile() failed with error:\n%v", err)
+    }
+
+    opt, err := driver.UnmarshalConfigYAML(data)
+    if err != nil {
+        test.Fatalf("UnmarshalConfigYAML() returned:\n%v", err)
+    }
+    if !reflect.DeepEqual(opt, encodedConfig) {
+        test.Errorf("UnmarshalConfigYAML() decoded\n%+v\nexpected\n%+v", opt, encodedConfig)
+    }
+
+    // Test failure cases
+    failures := map[string]string{
+        "unknown-field": "apiVersion: docker-driver.physarumsm/v1\nimage: busybox\nmemroy: 512m\n",
+        "unknown-version": "apiVersion: docker-driver.physarumsm/v9\nimage: busybox\n",
+        "no-version": "image: busybox\n",
+        "bad-memory": "apiVersion: docker-driver.physarumsm/v1\nimage: busybox\nmemory: lots\n",
+    }
+    for name, data := range failures {
+        if _, err := driver.UnmarshalConfigYAML([]byte(data)); err == nil {
+            test.Errorf("%s: UnmarshalConfigYAML() succeeded, expected it to fail", name)
+        }
+    }
+}
+
+func TestConfigRoundTrip(test *testing.T) {
+    data, err := driver.MarshalConfigJSON(encodedConfig)
+    if err != nil {
+        test.Fatalf("MarshalConfigJSON() returned:\n%v", err)
+    }
+    if !strings.Contains(string(data), `"apiVersion": "` + driver.ConfigAPIVersion + `"`) ||
+        !strings.Contains(string(data), `"memory": "512MiB"`) {
+        test.Errorf("MarshalConfigJSON() returned\n%s\nexpected apiVersion and human-readable memory", data)
+    }
+    opt, err := driver.UnmarshalConfigJSON(data)
+    if err != nil || !reflect.DeepEqual(opt, encodedConfig) {
+        test.Errorf("UnmarshalConfigJSON() decoded\n%+v, %v\nexpected\n%+v", opt, err, encodedConfig)
+    }
+
+    data, err = driver.MarshalConfigYAML(encodedConfig)
+    if err != nil {
+        test.Fatalf("MarshalConfigYAML() returned:\n%v", err)
+    }
+    opt, err = driver.UnmarshalConfigYAML(data)
+    if err != nil || !reflect.DeepEqual(opt, encodedConfig) {
+        test.Errorf("UnmarshalConfigYAML() decoded\n%+v, %v\nexpected\n%+v", opt, err, encodedConfig)
+    }
+
+    // Test failure cases
+    failures := map[string]string{
+        "unknown-field": `{"apiVersion": "docker-driver.physarumsm/v1", "image": "busybox", "cpus": 1}`,
+        "trailing-data": `{"apiVersion": "docker-driver.physarumsm/v1", "image": "busybox"} {}`,
+        "legacy-unknown-field": `{"Image": "busybox", "Memroy": 1}`,
+    }
+    for name, data := range failures {
+        if _, err := driver.UnmarshalConfigJSON([]byte(data)); err == nil {
+            test.Errorf("%s: UnmarshalConfigJSON() succeeded, expected it to fail", name)
+        }
+    }
+}
+
+func TestUnmarshalConfigJSONLegacy(test *testing.T) {
+    // Files written before apiVersion were encoding/json's output for DockerConfig
+    legacy, err := json.Marshal(encodedConfig)
+    if err != nil {
+        test.Fatalf("Marshal() returned:\n%v", err)
+    }
+
+    opt, err := driver.UnmarshalConfigJSON(legacy)
+    if err != nil {
+        test.Fatalf("UnmarshalConfigJSON() returned:\n%v", err)
+    }
+    if !reflect.DeepEqual(opt, encodedConfig) {
+        test.Errorf("UnmarshalConfigJSON() migrated\n%+v\nexpected\n%+v", opt, encodedConfig)
+    }
+}
+
+func TestConfigJSONSchema(test *testing.T) {
+    data, err := driver.ConfigJSONSchema()
+    if err != nil {
+        test.Fatalf("ConfigJSONSchema() returned:\n%v", err)
+    }
+
+    var schema struct {
+        Properties map[string]map[string]interface{}
+        Required []string
+        AdditionalProperties bool
+    }
+    if err := json.Unmarshal(data, &schema); err != nil {
+        test.Fatalf("ConfigJSONSchema() returned invalid JSON:\n%v", err)
+    }
+
+    if schema.Properties["apiVersion"]["const"] != driver.ConfigAPIVersion {
+        test.Errorf("Schema apiVersion is %v, expected const %s", schema.Properties["apiVersion"], driver.ConfigAPIVersion)
+    }
+    if !reflect.DeepEqual(schema.Required, []string{"apiVersion", "image"}) {
+        test.Errorf("Schema requires %v, expected apiVersion and image", schema.Required)
+    }
+    if schema.AdditionalProperties {
+        test.Errorf("Schema allows additional properties, expected strict like the decoder")
+    }
+    if _, ok := schema.Properties["memory"]["oneOf"]; !ok {
+        test.Errorf("Schema memory is %v, expected number or string", schema.Properties["memory"])
+    }
+
+    // Encoded configs must pass the schema, including the empty Cmd that disables the image's check
+    var full map[string]interface{}
+    json.Unmarshal(data, &full)
+    disabled := driver.DockerConfig{Image: "busybox", HealthCheck: &driver.HealthCheck{}}
+    for _, opt := range []driver.DockerConfig{encodedConfig, disabled} {
+        encoded, err := driver.MarshalConfigJSON(opt)
+        if err != nil {
+            test.Fatalf("MarshalConfigJSON() returned:\n%v", err)
+        }
+        var doc interface{}
+        json.Unmarshal(encoded, &doc)
+        if problems := schemaProblems(full, doc, ""); len(problems) > 0 {
+            test.Errorf("MarshalConfigJSON() output does not match the schema:\n%s\n%v", encoded, problems)
+        }
+
+        decoded, err := driver.UnmarshalConfigJSON(encoded)
+        if err != nil || !reflect.DeepEqual(decoded, opt) {
+            test.Errorf("UnmarshalConfigJSON() returned\n%+v, %v\nexpected\n%+v", decoded, err, opt)
+        }
+    }
+}
+
+// Check doc against the subset of JSON Schema that ConfigJSONSchema produces
+func schemaProblems(schema map[string]interface{}, doc interface{}, path string) []string {
+    var problems []string
+    if options, ok := schema["oneOf"].([]interface{}); ok {
+        matched := 0
+        for _, option := range options {
+            if len(schemaProblems(option.(map[string]interface{}), doc, path)) == 0 {
+                matched++
+            }
+        }
+        if matched != 1 {
+            problems = append(problems, fmt.Sprintf("%s: matches %d of oneOf", path, matched))
+        }
+    }
+    if value, ok := schema["const"]; ok && doc != value {
+        problems = append(problems, fmt.Sprintf("%s: %v is not %v", path, doc, value))
+    }
+
+    switch schema["type"] {
+    case "object":
+        object, ok := doc.(map[string]interface{})
+        if !ok {
+            return append(problems, fmt.Sprintf("%s: %v is not an object", path, doc))
+        }
+        required, _ := schema["required"].([]interface{})
+        for _, name := range required {
+            if _, ok := object[name.(string)]; !ok {
+                problems = append(problems, fmt.Sprintf("%s: missing %v", path, name))
+            }
+        }
+        properties, _ := schema["properties"].(map[string]interface{})
+        for name, value := range object {
+            if property, ok := properties[name]; ok {
+                problems = append(problems, schemaProblems(property.(map[string]interface{}), value, path + "/" + name)...)
+            } else if additional, ok := schema["additionalProperties"].(map[string]interface{}); ok {
+                problems = append(problems, schemaProblems(additional, value, path + "/" + name)...)
+            } else {
+                problems = append(problems, fmt.Sprintf("%s: unexpected %s", path, name))
+            }
+        }
+    case "array":
+        array, ok := doc.([]interface{})
+        if !ok {
+            return append(problems, fmt.Sprintf("%s: %v is not an array", path, doc))
+        }
+        for i, item := range array {
+            problems = append(problems, schemaProblems(schema["items"].(map[string]interface{}), item, fmt.Sprintf("%s/%d", path, i))...)
+        }
+    case "string":
+        if _, ok := doc.(string); !ok {
+            problems = append(problems, fmt.Sprintf("%s: %v is not a string", path, doc))
+        }
+    case "boolean":
+        if _, ok := doc.(bool); !ok {
+            problems = append(problems, fmt.Sprintf("%s: %v is not a boolean", path, doc))
+        }
+    case "number", "integer":
+        if _, ok := doc.(float64); !ok {
+            problems = append(problems, fmt.Sprintf("%s: %v is not a number", path, doc))
+        }
+    }
+    return problems
+}
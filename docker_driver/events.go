@@ -0,0 +1,300 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver
+
+import (
+    "fmt"
+    "io"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/docker/docker/api/types"
+    "github.com/docker/docker/api/types/events"
+    "github.com/docker/docker/api/types/filters"
+    "github.com/docker/docker/client"
+    "github.com/docker/docker/errdefs"
+    "golang.org/x/net/context"
+)
+
+// Event types
+const (
+    EventTypeContainer = events.ContainerEventType
+    EventTypeImage = events.ImageEventType
+    EventTypeNetwork = events.NetworkEventType
+    EventTypeVolume = events.VolumeEventType
+    EventTypeDaemon = events.DaemonEventType
+)
+
+// Event actions we act on, the daemon reports many more
+const (
+    EventStart = "start"
+    EventStop = "stop"
+    EventDie = "die"
+    EventKill = "kill"
+    EventOOM = "oom"
+    EventHealthStatus = "health_status"
+    EventDestroy = "destroy"
+    EventPause = "pause"
+    EventUnpause = "unpause"
+    EventPull = "pull"
+    EventDelete = "delete"
+)
+
+// Backoff between attempts to reconnect to the daemon's event stream
+const (
+    minEventsBackoff = 100 * time.Millisecond
+    maxEventsBackoff = 10 * time.Second
+)
+
+// Failed reconnects in a row before SubscribeEvents gives up, about a minute of backoff
+const defaultEventsReconnects = 10
+
+// Events must match every non-empty field, and any value within a field
+type EventFilter struct {
+    Types []string
+    Actions []string
+    Containers []string     // IDs or names
+    Labels []string         // "key" or "key=value"
+    Images []string
+}
+
+// Options for SubscribeEvents
+// A zero Since starts from now, a non-zero Since replays past events first
+// A zero Until streams forever, a non-zero Until ends the stream at that time
+// Since and Until are compared against the daemon's clock, not ours
+type EventOptions struct {
+    Filter EventFilter
+    Since time.Time
+    Until time.Time
+    MaxReconnects int       // failed reconnects in a row before giving up, default is defaultEventsReconnects
+}
+
+// A daemon event
+type Event struct {
+    Type string
+    Action string            // health_status events have their status split into HealthStatus
+    ID string                // container ID, image name, etc. depending on Type
+    Name string              // container name, if any
+    Image string             // container image, if any
+    ExitCode int             // only set for die events
+    HealthStatus string      // only set for health_status events
+    Signal string            // only set for kill events
+    Attributes map[string]string
+    Time time.Time
+}
+
+func (filter EventFilter) toDocker() filters.Args {
+    args := filters.NewArgs()
+    for _, value := range filter.Types {
+        args.Add("type", value)
+    }
+    for _, value := range filter.Actions {
+        args.Add("event", value)
+    }
+    for _, value := range filter.Containers {
+        args.Add("container", value)
+    }
+    for _, value := range filter.Labels {
+        args.Add("label", value)
+    }
+    for _, value := range filter.Images {
+        args.Add("image", value)
+    }
+    return args
+}
+
+// Docker's since/until format: seconds.nanoseconds since the epoch
+func eventTimestamp(t time.Time) string {
+    if t.IsZero() {
+        return ""
+    }
+    return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+}
+
+func newEvent(msg events.Message) Event {
+    event := Event{
+        Type: msg.Type,
+        Action: msg.Action,
+        ID: msg.Actor.ID,
+        Name: msg.Actor.Attributes["name"],
+        Attributes: msg.Actor.Attributes,
+        Time: time.Unix(0, msg.TimeNano),
+    }
+    if msg.TimeNano == 0 {
+        event.Time = time.Unix(msg.Time, 0)
+    }
+    if msg.Type == EventTypeContainer {
+        event.Image = msg.Actor.Attributes["image"]
+    }
+
+    switch {
+    case msg.Action == EventDie:
+        event.ExitCode, _ = strconv.Atoi(msg.Actor.Attributes["exitCode"])
+    case msg.Action == EventKill:
+        event.Signal = msg.Actor.Attributes["signal"]
+    case strings.HasPrefix(msg.Action, EventHealthStatus):
+        // Reported as "health_status: healthy"
+        event.Action = EventHealthStatus
+        event.HealthStatus = strings.TrimSpace(strings.TrimPrefix(msg.Action, EventHealthStatus + ":"))
+    }
+
+    return event
+}
+
+// Subscribe to daemon events matching opts until ctx is cancelled
+// The subscription reconnects if the daemon restarts, resuming from the last
+// event received so none are lost or repeated
+// Both channels are closed when the subscription ends; an error is sent first
+// if it ended for any reason other than ctx being cancelled or Until passing,
+// including the daemon refusing us or staying unreachable past MaxReconnects
+func SubscribeEvents(ctx context.Context, opts EventOptions) (<-chan Event, <-chan error) {
+    out := make(chan Event)
+    errs := make(chan error, 1)
+
+    maxReconnects := opts.MaxReconnects
+    if maxReconnects <= 0 {
+        maxReconnects = defaultEventsReconnects
+    }
+
+    since := opts.Since
+    pinned := since.IsZero()
+    if pinned {
+        // Pin the start before returning, so that callers can subscribe and
+        // then list without missing changes in between, and so that a
+        // reconnect before the first event does not skip any
+        since = time.Now()
+    }
+
+    go func() {
+        defer close(errs)
+        defer close(out)
+
+        cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+        if err != nil {
+            errs <- err
+            return
+        }
+        defer cli.Close()
+
+        // The pinned start is on our clock, move it onto the daemon's so that
+        // skew against a remote daemon does not drop or replay events
+        if pinned {
+            if skew, err := daemonClockSkew(ctx, cli); err == nil {
+                since = since.Add(skew)
+            }
+        }
+
+        // Events already delivered at the resume timestamp, so replay skips them
+        var lastNano int64
+        seen := make(map[string]bool)
+        backoff := minEventsBackoff
+        failures := 0
+
+        for {
+            connected := time.Now()
+            received := false
+            messages, streamErrs := cli.Events(ctx, types.EventsOptions{
+                Since: eventTimestamp(since),
+                Until: eventTimestamp(opts.Until),
+                Filters: opts.Filter.toDocker(),
+            })
+
+            err := forwardEvents(ctx, messages, streamErrs, out, func(msg events.Message) bool {
+                key := msg.Type + "/" + msg.Action + "/" + msg.Actor.ID
+                if msg.TimeNano < lastNano || (msg.TimeNano == lastNano && seen[key]) {
+                    return false
+                }
+                if msg.TimeNano > lastNano {
+                    lastNano = msg.TimeNano
+                    seen = make(map[string]bool)
+                }
+                seen[key] = true
+                since = time.Unix(0, msg.TimeNano)
+                received = true
+                return true
+            })
+            if ctx.Err() != nil {
+                return
+            }
+            if err == io.EOF && !opts.Until.IsZero() && !time.Now().Before(opts.Until) {
+                return
+            }
+            if errdefs.IsInvalidParameter(err) || errdefs.IsUnauthorized(err) || errdefs.IsForbidden(err) {
+                errs <- err
+                return
+            }
+
+            // A connection that delivered events or stayed up was not a failed reconnect
+            if received || time.Since(connected) >= maxEventsBackoff {
+                failures = 0
+                backoff = minEventsBackoff
+            }
+            failures++
+            if failures > maxReconnects {
+                errs <- fmt.Errorf("docker_driver: Error event stream failed %d times in a row: %v", failures, err)
+                return
+            }
+
+            // Daemon went away or restarted, retry until it is back
+            select {
+            case <-ctx.Done():
+                return
+            case <-time.After(backoff):
+            }
+            backoff *= 2
+            if backoff > maxEventsBackoff {
+                backoff = maxEventsBackoff
+            }
+        }
+    }()
+
+    return out, errs
+}
+
+// How far the daemon's clock is ahead of ours
+// Errs towards behind, so a start moved by it replays rather than drops events
+func daemonClockSkew(ctx context.Context, cli *client.Client) (time.Duration, error) {
+    info, err := cli.Info(ctx)
+    if err != nil {
+        return 0, err
+    }
+    daemonTime, err := time.Parse(time.RFC3339Nano, info.SystemTime)
+    if err != nil {
+        return 0, err
+    }
+    // SystemTime was read before the response arrived
+    return daemonTime.Sub(time.Now()), nil
+}
+
+// Forward messages from one event stream connection until it ends
+// accept reports whether a message is new and should be delivered
+func forwardEvents(ctx context.Context, messages <-chan events.Message, streamErrs <-chan error, out chan<- Event, accept func(events.Message) bool) error {
+    for {
+        select {
+        case msg := <-messages:
+            if !accept(msg) {
+                continue
+            }
+            select {
+            case out <- newEvent(msg):
+            case <-ctx.Done():
+                return ctx.Err()
+            }
+        case err := <-streamErrs:
+            return err
+        }
+    }
+}
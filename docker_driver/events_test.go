@@ -0,0 +1,165 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver_test
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    driver "github.com/PhysarumSM/docker-driver/docker_driver"
+)
+
+const (
+    startEvent = `{"Type": "container", "Action": "start", "Actor": {"ID": "abc", "Attributes": {"name": "web", "image": "busybox"}}, "time": 1597946530, "timeNano": 1597946530000000001}`
+    healthEvent = `{"Type": "container", "Action": "health_status: healthy", "Actor": {"ID": "abc", "Attributes": {"name": "web", "image": "busybox"}}, "time": 1597946531, "timeNano": 1597946531000000001}`
+    dieEvent = `{"Type": "container", "Action": "die", "Actor": {"ID": "abc", "Attributes": {"name": "web", "image": "busybox", "exitCode": "137"}}, "time": 1597946532, "timeNano": 1597946532000000001}`
+)
+
+func TestSubscribeEvents(test *testing.T) {
+    daemon := newFakeDaemon(test)
+    defer daemon.close()
+
+    var connects int32
+    var resumedSince atomic.Value
+    daemon.handle("/events", func(w http.ResponseWriter, r *http.Request) {
+        if atomic.AddInt32(&connects, 1) == 1 {
+            // First connection drops after one event, as if the daemon restarted
+            w.Write([]byte(startEvent + "\n"))
+            return
+        }
+
+        // Replay from the resume point repeats the last delivered event
+        resumedSince.Store(r.URL.Query().Get("since"))
+        w.Write([]byte(startEvent + "\n" + healthEvent + "\n" + dieEvent + "\n"))
+        w.(http.Flusher).Flush()
+        <-r.Context().Done()
+    })
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    events, errs := driver.SubscribeEvents(ctx, driver.EventOptions{
+        Filter: driver.EventFilter{Types: []string{driver.EventTypeContainer}},
+    })
+
+    var received []driver.Event
+    for len(received) < 3 {
+        select {
+        case event := <-events:
+            received = append(received, event)
+        case err := <-errs:
+            test.Fatalf("SubscribeEvents() returned:\n%v", err)
+        case <-time.After(5 * time.Second):
+            test.Fatalf("SubscribeEvents() timed out after %d events", len(received))
+        }
+    }
+
+    if received[0].Action != driver.EventStart || received[0].Name != "web" || received[0].Image != "busybox" {
+        test.Errorf("SubscribeEvents() returned %+v, expected start of web", received[0])
+    }
+    if received[1].Action != driver.EventHealthStatus || received[1].HealthStatus != "healthy" {
+        test.Errorf("SubscribeEvents() returned %+v, expected healthy health_status", received[1])
+    }
+    if received[2].Action != driver.EventDie || received[2].ExitCode != 137 {
+        test.Errorf("SubscribeEvents() returned %+v, expected die with exit code 137", received[2])
+    }
+    if since, _ := resumedSince.Load().(string); since != "1597946530.000000001" {
+        test.Errorf("SubscribeEvents() resumed from %q, expected the last delivered event", since)
+    }
+
+    cancel()
+    for range events {
+    }
+    if err := <-errs; err != nil {
+        test.Errorf("SubscribeEvents() returned after cancel:\n%v", err)
+    }
+}
+
+func TestSubscribeEventsGivesUp(test *testing.T) {
+    daemon := newFakeDaemon(test)
+    defer daemon.close()
+
+    var connects int32
+    daemon.handle("/events", func(w http.ResponseWriter, r *http.Request) {
+        atomic.AddInt32(&connects, 1)
+        w.WriteHeader(http.StatusServiceUnavailable)
+    })
+
+    events, errs := driver.SubscribeEvents(context.Background(), driver.EventOptions{MaxReconnects: 2})
+    select {
+    case err := <-errs:
+        if err == nil {
+            test.Errorf("SubscribeEvents() ended without an error, expected the reconnect failures")
+        }
+    case <-time.After(5 * time.Second):
+        test.Fatalf("SubscribeEvents() kept retrying an unavailable daemon")
+    }
+    for range events {
+    }
+    if n := atomic.LoadInt32(&connects); n != 3 {
+        test.Errorf("SubscribeEvents() connected %d times, expected 3", n)
+    }
+
+    // Refusals are not retried
+    atomic.StoreInt32(&connects, 0)
+    daemon.handle("/events", func(w http.ResponseWriter, r *http.Request) {
+        atomic.AddInt32(&connects, 1)
+        w.WriteHeader(http.StatusUnauthorized)
+    })
+    _, errs = driver.SubscribeEvents(context.Background(), driver.EventOptions{})
+    select {
+    case err := <-errs:
+        if err == nil || atomic.LoadInt32(&connects) != 1 {
+            test.Errorf("SubscribeEvents() returned %v after %d connects, expected the refusal at once", err, connects)
+        }
+    case <-time.After(5 * time.Second):
+        test.Fatalf("SubscribeEvents() retried an unauthorized subscription")
+    }
+}
+
+func TestSubscribeEventsClockSkew(test *testing.T) {
+    daemon := newFakeDaemon(test)
+    defer daemon.close()
+
+    // Daemon clock an hour ahead of ours
+    daemon.handle("/info", func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(`{"SystemTime": "` + time.Now().Add(time.Hour).Format(time.RFC3339Nano) + `"}`))
+    })
+    sinces := make(chan string, 1)
+    daemon.handle("/events", func(w http.ResponseWriter, r *http.Request) {
+        sinces <- r.URL.Query().Get("since")
+        <-r.Context().Done()
+    })
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    start := time.Now()
+    driver.SubscribeEvents(ctx, driver.EventOptions{})
+
+    select {
+    case since := <-sinces:
+        var secs, nanos int64
+        fmt.Sscanf(since, "%d.%d", &secs, &nanos)
+        offset := time.Unix(secs, nanos).Sub(start)
+        if offset < 59 * time.Minute || offset > time.Hour {
+            test.Errorf("SubscribeEvents() started from %v after subscribing, expected just under the daemon's hour of skew", offset)
+        }
+    case <-time.After(5 * time.Second):
+        test.Fatalf("SubscribeEvents() did not connect")
+    }
+}
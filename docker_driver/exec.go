@@ -0,0 +1,218 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver
+
+import (
+    "bytes"
+    "errors"
+    "io"
+    "time"
+
+    "github.com/docker/docker/api/types"
+    "github.com/docker/docker/client"
+    "github.com/docker/docker/pkg/stdcopy"
+    "golang.org/x/net/context"
+)
+
+// How often to re-inspect an exec whose output has ended but has not been reaped yet
+const execPollInterval = 50 * time.Millisecond
+
+// Command to run inside a running container
+// Empty User and WorkingDir use the container's own settings
+type ExecOptions struct {
+    Cmd []string
+    Env []string
+    User string
+    WorkingDir string
+    Tty bool            // stdout and stderr are merged when set
+    Stdin io.Reader     // optional, closed from the command's side on EOF, Exec stops reading it once the command exits
+    AttachStdin bool    // attach stdin without a Stdin, for ExecSession.Write, implied by Stdin
+}
+
+// Output of a finished Exec
+type ExecResult struct {
+    Stdout string
+    Stderr string
+    ExitCode int
+}
+
+// An exec attached over a hijacked connection to the daemon
+// Write sends to the command's stdin, Read returns its raw output
+// (stdcopy-multiplexed unless Tty is set, use Copy to split it)
+// Close must be called once done with the session
+type ExecSession struct {
+    ID string
+    Tty bool
+
+    stdin bool
+    ctx context.Context
+    cli *client.Client
+    resp types.HijackedResponse
+}
+
+// Run a command inside a running container and wait for it to finish
+func Exec(cont string, opts ExecOptions) (ExecResult, error) {
+    session, err := ExecStream(context.Background(), cont, opts)
+    if err != nil {
+        return ExecResult{}, err
+    }
+    defer session.Close()
+
+    if opts.Stdin != nil {
+        done := make(chan struct{})
+        defer close(done)
+        go copyStdin(session, opts.Stdin, done)
+    }
+
+    var outBuf, errBuf bytes.Buffer
+    err = session.Copy(&outBuf, &errBuf)
+    if err != nil {
+        return ExecResult{}, err
+    }
+
+    exitCode, err := session.Wait()
+    if err != nil {
+        return ExecResult{}, err
+    }
+
+    return ExecResult{Stdout: outBuf.String(), Stderr: errBuf.String(), ExitCode: exitCode}, nil
+}
+
+// Start a command inside a running container and attach to it
+// Meant for long-running or interactive sessions, see ExecSession
+// Cancelling ctx does not kill the command, Close the session to detach
+func ExecStream(ctx context.Context, cont string, opts ExecOptions) (*ExecSession, error) {
+    if len(opts.Cmd) == 0 {
+        return nil, errors.New("docker_driver: Error exec requires a command")
+    }
+
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return nil, err
+    }
+
+    execResp, err := cli.ContainerExecCreate(ctx, cont, types.ExecConfig{
+        User: opts.User,
+        Tty: opts.Tty,
+        AttachStdin: opts.AttachStdin || opts.Stdin != nil,
+        AttachStdout: true,
+        AttachStderr: true,
+        Env: opts.Env,
+        WorkingDir: opts.WorkingDir,
+        Cmd: opts.Cmd,
+    })
+    if err != nil {
+        cli.Close()
+        return nil, err
+    }
+
+    resp, err := cli.ContainerExecAttach(ctx, execResp.ID, types.ExecStartCheck{Tty: opts.Tty})
+    if err != nil {
+        cli.Close()
+        return nil, err
+    }
+
+    return &ExecSession{
+        ID: execResp.ID,
+        Tty: opts.Tty,
+        stdin: opts.AttachStdin || opts.Stdin != nil,
+        ctx: ctx,
+        cli: cli,
+        resp: resp,
+    }, nil
+}
+
+// Feed stdin to the session until it runs out or done is closed
+// A Read already blocked when done closes returns on its own, its data is dropped
+func copyStdin(session *ExecSession, stdin io.Reader, done <-chan struct{}) {
+    buf := make([]byte, 32 * 1024)
+    for {
+        n, err := stdin.Read(buf)
+        select {
+        case <-done:
+            return
+        default:
+        }
+        if n > 0 {
+            if _, werr := session.Write(buf[:n]); werr != nil {
+                return
+            }
+        }
+        if err != nil {
+            session.CloseWrite()
+            return
+        }
+    }
+}
+
+// Raw output of the command
+func (session *ExecSession) Read(p []byte) (int, error) {
+    return session.resp.Reader.Read(p)
+}
+
+// Send input to the command's stdin
+// Fails unless the session was started with Stdin or AttachStdin
+func (session *ExecSession) Write(p []byte) (int, error) {
+    if !session.stdin {
+        return 0, errors.New("docker_driver: Error exec session was started without stdin attached")
+    }
+    return session.resp.Conn.Write(p)
+}
+
+// Signal EOF on the command's stdin
+func (session *ExecSession) CloseWrite() error {
+    return session.resp.CloseWrite()
+}
+
+// Copy the command's output until it ends, demultiplexing it unless Tty is set
+func (session *ExecSession) Copy(stdout, stderr io.Writer) error {
+    var err error
+    if session.Tty {
+        _, err = io.Copy(stdout, session.resp.Reader)
+    } else {
+        _, err = stdcopy.StdCopy(stdout, stderr, session.resp.Reader)
+    }
+    return err
+}
+
+// Resize the command's TTY
+func (session *ExecSession) Resize(height, width uint) error {
+    return session.cli.ContainerExecResize(session.ctx, session.ID, types.ResizeOptions{Height: height, Width: width})
+}
+
+// Block until the command exits and return its exit code
+func (session *ExecSession) Wait() (int, error) {
+    for {
+        info, err := session.cli.ContainerExecInspect(session.ctx, session.ID)
+        if err != nil {
+            return 0, err
+        }
+        if !info.Running {
+            return info.ExitCode, nil
+        }
+
+        select {
+        case <-session.ctx.Done():
+            return 0, session.ctx.Err()
+        case <-time.After(execPollInterval):
+        }
+    }
+}
+
+// Detach from the command and release the connection to the daemon
+func (session *ExecSession) Close() error {
+    session.resp.Close()
+    return session.cli.Close()
+}
@@ -0,0 +1,158 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver_test
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    driver "github.com/PhysarumSM/docker-driver/docker_driver"
+    "github.com/docker/docker/api/types"
+    "github.com/docker/docker/pkg/stdcopy"
+)
+
+// Serve an exec that echoes its stdin to stdout, or exits straight away if echo is false
+// Returns the exec config the driver created
+func serveExec(test *testing.T, daemon *fakeDaemon, echo bool) *types.ExecConfig {
+    config := &types.ExecConfig{}
+    daemon.handle("/containers/c1/exec", func(w http.ResponseWriter, r *http.Request) {
+        json.NewDecoder(r.Body).Decode(config)
+        w.WriteHeader(http.StatusCreated)
+        w.Write([]byte(`{"Id": "e1"}`))
+    })
+    daemon.handle("/exec/e1/start", func(w http.ResponseWriter, r *http.Request) {
+        conn, buf, err := w.(http.Hijacker).Hijack()
+        if err != nil {
+            test.Errorf("Hijack() failed with error:\n%v", err)
+            return
+        }
+        defer conn.Close()
+        buf.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\n" +
+            "Connection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+        buf.Flush()
+
+        var input []byte
+        if echo {
+            input, _ = ioutil.ReadAll(bufio.NewReader(conn))
+        }
+        stdcopy.NewStdWriter(conn, stdcopy.Stdout).Write(append([]byte("out:"), input...))
+    })
+    daemon.handle("/exec/e1/json", func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(`{"ID": "e1", "Running": false, "ExitCode": 0}`))
+    })
+    return config
+}
+
+func TestExecStreamAttachStdin(test *testing.T) {
+    daemon := newFakeDaemon(test)
+    defer daemon.close()
+    config := serveExec(test, daemon, true)
+
+    session, err := driver.ExecStream(context.Background(), "c1", driver.ExecOptions{Cmd: []string{"cat"}, AttachStdin: true})
+    if err != nil {
+        test.Fatalf("ExecStream() returned:\n%v", err)
+    }
+    defer session.Close()
+    if !config.AttachStdin {
+        test.Errorf("ExecStream() did not attach stdin with AttachStdin set")
+    }
+
+    if _, err := session.Write([]byte("hello")); err != nil {
+        test.Fatalf("Write() returned:\n%v", err)
+    }
+    session.CloseWrite()
+
+    var stdout, stderr strings.Builder
+    if err := session.Copy(&stdout, &stderr); err != nil || stdout.String() != "out:hello" {
+        test.Errorf("Copy() returned %q, %v, expected %q", stdout.String(), err, "out:hello")
+    }
+}
+
+func TestExecStreamWithoutStdin(test *testing.T) {
+    daemon := newFakeDaemon(test)
+    defer daemon.close()
+    config := serveExec(test, daemon, false)
+
+    session, err := driver.ExecStream(context.Background(), "c1", driver.ExecOptions{Cmd: []string{"true"}})
+    if err != nil {
+        test.Fatalf("ExecStream() returned:\n%v", err)
+    }
+    defer session.Close()
+    if config.AttachStdin {
+        test.Errorf("ExecStream() attached stdin with neither Stdin nor AttachStdin set")
+    }
+
+    // Would otherwise be dropped without a word
+    if _, err := session.Write([]byte("lost")); err == nil {
+        test.Errorf("Write() succeeded on a session without stdin, expected it to fail")
+    }
+}
+
+// Reader that blocks until fed, counting its reads
+type blockingReader struct {
+    *io.PipeReader
+    mu sync.Mutex
+    reads int
+}
+
+func (reader *blockingReader) Read(p []byte) (int, error) {
+    reader.mu.Lock()
+    reader.reads++
+    reader.mu.Unlock()
+    return reader.PipeReader.Read(p)
+}
+
+func TestExecStdinNotDrained(test *testing.T) {
+    daemon := newFakeDaemon(test)
+    defer daemon.close()
+    serveExec(test, daemon, false)
+
+    pr, pw := io.Pipe()
+    stdin := &blockingReader{PipeReader: pr}
+    finished := make(chan error, 1)
+    go func() {
+        result, err := driver.Exec("c1", driver.ExecOptions{Cmd: []string{"true"}, Stdin: stdin})
+        if err == nil && result.Stdout != "out:" {
+            test.Errorf("Exec() returned stdout %q, expected %q", result.Stdout, "out:")
+        }
+        finished <- err
+    }()
+
+    select {
+    case err := <-finished:
+        if err != nil {
+            test.Fatalf("Exec() returned:\n%v", err)
+        }
+    case <-time.After(5 * time.Second):
+        test.Fatalf("Exec() blocked on a Stdin the command never read")
+    }
+
+    // The pending read is released, and nothing more is read afterwards
+    pw.Write([]byte("late"))
+    time.Sleep(50 * time.Millisecond)
+    stdin.mu.Lock()
+    defer stdin.mu.Unlock()
+    if stdin.reads != 1 {
+        test.Errorf("Exec() read Stdin %d times, expected it to stop after the command exited", stdin.reads)
+    }
+}
@@ -0,0 +1,199 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver
+
+import (
+    "errors"
+    "io"
+    "strconv"
+    "time"
+
+    "github.com/docker/docker/api/types"
+    "github.com/docker/docker/api/types/events"
+    "github.com/docker/docker/api/types/filters"
+    "github.com/docker/docker/client"
+    "golang.org/x/net/context"
+)
+
+// Why a container stopped
+const (
+    ExitCompleted = "completed"             // exited by itself with code 0
+    ExitError = "error"                     // exited by itself with a non-zero code
+    ExitOOMKilled = "oom-killed"            // killed by the kernel for exceeding its memory limit
+    ExitSignal = "signal"                   // killed by a signal not sent through StopContainer
+    ExitStopped = "stopped"                 // stopped through StopContainer (or docker stop)
+    ExitStartFailed = "start-failed"        // never started, see Error
+    ExitUnknown = "unknown"                 // killed by a signal (a daemon shutdown included), but the daemon no longer has the events to say why
+)
+
+const defaultExitLogLines = 20
+
+// Signals containers are commonly killed with, by number
+var signalNames = map[int]string{
+    1: "SIGHUP",
+    2: "SIGINT",
+    3: "SIGQUIT",
+    6: "SIGABRT",
+    9: "SIGKILL",
+    11: "SIGSEGV",
+    15: "SIGTERM",
+}
+
+// Classified reason for a container having stopped
+type ExitReason struct {
+    Reason string          // one of the Exit* constants
+    ExitCode int
+    Signal string           // signal that ended the container, if any
+    Error string            // daemon error, e.g. why the container failed to start
+    FinishedAt time.Time
+    Logs []string           // last log lines of the container
+}
+
+// Classify why a container stopped, from its state and the daemon's recent events
+// logLines is the number of final log lines to include, 0 uses a default of 20
+// The daemon only keeps recent events in memory, so a container killed by a signal
+// whose events have been evicted, or lost to a daemon restart, is reported as ExitUnknown
+// That includes containers stopped by a daemon shutdown, which cannot be told apart
+// once the daemon has restarted without the events
+func GetExitReason(cont string, logLines int) (ExitReason, error) {
+    ctx := context.Background()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return ExitReason{}, err
+    }
+    defer cli.Close()
+
+    if logLines <= 0 {
+        logLines = defaultExitLogLines
+    }
+
+    info, err := cli.ContainerInspect(ctx, cont)
+    if err != nil {
+        return ExitReason{}, err
+    }
+    if info.ContainerJSONBase == nil || info.State == nil {
+        return ExitReason{}, errors.New("docker_driver: Error container has no state " + cont)
+    }
+    if info.State.Running || info.State.Restarting {
+        return ExitReason{}, errors.New("docker_driver: Error container is still running " + cont)
+    }
+
+    startedAt, _ := time.Parse(time.RFC3339Nano, info.State.StartedAt)
+    finishedAt, _ := time.Parse(time.RFC3339Nano, info.State.FinishedAt)
+
+    var msgs []events.Message
+    if !startedAt.IsZero() && !finishedAt.IsZero() {
+        msgs, err = containerEvents(ctx, cli, info.ID, startedAt, finishedAt.Add(time.Second))
+        if err != nil {
+            return ExitReason{}, err
+        }
+    }
+
+    reason := classifyExit(info.State, msgs, stoppedByDriver(info.ID, info.State.StartedAt))
+    reason.FinishedAt = finishedAt
+    reason.Logs, _ = tailLogs(ctx, cli, info.ID, logLines)
+
+    return reason, nil
+}
+
+// Replay a container's events between since and until
+func containerEvents(ctx context.Context, cli *client.Client, id string, since, until time.Time) ([]events.Message, error) {
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    messages, errs := cli.Events(ctx, types.EventsOptions{
+        Since: eventTimestamp(since),
+        Until: eventTimestamp(until),
+        Filters: filters.NewArgs(
+            filters.Arg("type", EventTypeContainer),
+            filters.Arg("container", id),
+        ),
+    })
+
+    var msgs []events.Message
+    for {
+        select {
+        case msg := <-messages:
+            msgs = append(msgs, msg)
+        case err := <-errs:
+            if err == io.EOF {
+                return msgs, nil
+            }
+            return nil, err
+        }
+    }
+}
+
+// stopped is set if this process stopped the container with its own signal
+func classifyExit(state *types.ContainerState, msgs []events.Message, stopped bool) ExitReason {
+    reason := ExitReason{ExitCode: state.ExitCode, Error: state.Error}
+
+    var started, died bool
+    var killSignal string
+    for _, msg := range msgs {
+        switch msg.Action {
+        case EventStart:
+            started = true
+        case EventDie:
+            died = true
+        case EventStop:
+            stopped = true
+        case EventKill:
+            killSignal = msg.Actor.Attributes["signal"]
+        }
+    }
+    if killSignal != "" {
+        if number, err := strconv.Atoi(killSignal); err == nil && signalNames[number] != "" {
+            killSignal = signalNames[number]
+        }
+    }
+
+    // Exit codes above 128 mean the process was ended by signal (code - 128)
+    exitSignal := ""
+    if state.ExitCode > 128 {
+        number := state.ExitCode - 128
+        exitSignal = signalNames[number]
+        if exitSignal == "" {
+            exitSignal = strconv.Itoa(number)
+        }
+    }
+
+    switch {
+    case state.OOMKilled:
+        reason.Reason = ExitOOMKilled
+        reason.Signal = "SIGKILL"
+    case state.Error != "":
+        reason.Reason = ExitStartFailed
+    case stopped:
+        reason.Reason = ExitStopped
+        reason.Signal = exitSignal
+    case killSignal != "":
+        reason.Reason = ExitSignal
+        reason.Signal = killSignal
+    case !started && !died && exitSignal != "":
+        // No record of the container at all, its events are gone so do not guess
+        reason.Reason = ExitUnknown
+        reason.Signal = exitSignal
+    case exitSignal != "":
+        reason.Reason = ExitSignal
+        reason.Signal = exitSignal
+    case state.ExitCode != 0:
+        reason.Reason = ExitError
+    default:
+        reason.Reason = ExitCompleted
+    }
+
+    return reason
+}
@@ -0,0 +1,68 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver
+
+import (
+    "testing"
+
+    "github.com/docker/docker/api/types"
+    "github.com/docker/docker/api/types/events"
+)
+
+func event(action string, attributes map[string]string) events.Message {
+    return events.Message{Type: "container", Action: action, Actor: events.Actor{ID: "abc", Attributes: attributes}}
+}
+
+func TestClassifyExit(test *testing.T) {
+    started := event(EventStart, nil)
+    died := event(EventDie, nil)
+
+    cases := []struct {
+        name string
+        state types.ContainerState
+        msgs []events.Message
+        stopped bool
+        reason string
+        signal string
+    }{
+        {"completed", types.ContainerState{ExitCode: 0}, []events.Message{died}, false, ExitCompleted, ""},
+        {"error", types.ContainerState{ExitCode: 3}, []events.Message{died}, false, ExitError, ""},
+        {"oom", types.ContainerState{ExitCode: 137, OOMKilled: true}, []events.Message{died, event(EventOOM, nil)}, false, ExitOOMKilled, "SIGKILL"},
+        {"start-failed", types.ContainerState{ExitCode: 127, Error: "executable file not found"}, nil, false, ExitStartFailed, ""},
+        {"stopped", types.ContainerState{ExitCode: 143},
+            []events.Message{event(EventKill, map[string]string{"signal": "15"}), died, event(EventStop, nil)}, false, ExitStopped, "SIGTERM"},
+        {"stopped-by-driver", types.ContainerState{ExitCode: 137},
+            []events.Message{started, event(EventKill, map[string]string{"signal": "2"}), event(EventKill, map[string]string{"signal": "9"}), died}, true, ExitStopped, "SIGKILL"},
+        {"killed", types.ContainerState{ExitCode: 137},
+            []events.Message{event(EventKill, map[string]string{"signal": "9"}), died}, false, ExitSignal, "SIGKILL"},
+        {"crashed", types.ContainerState{ExitCode: 139}, []events.Message{started, died}, false, ExitSignal, "SIGSEGV"},
+        {"daemon-restarted", types.ContainerState{ExitCode: 143}, nil, false, ExitUnknown, "SIGTERM"},
+        {"start-evicted", types.ContainerState{ExitCode: 139}, []events.Message{died}, false, ExitSignal, "SIGSEGV"},
+        {"events-evicted", types.ContainerState{ExitCode: 139}, nil, false, ExitUnknown, "SIGSEGV"},
+        {"events-evicted-error", types.ContainerState{ExitCode: 2}, nil, false, ExitError, ""},
+    }
+
+    for _, c := range cases {
+        test.Run(c.name, func(test *testing.T) {
+            reason := classifyExit(&c.state, c.msgs, c.stopped)
+            if reason.Reason != c.reason || reason.Signal != c.signal {
+                test.Errorf("classifyExit() returned %s/%s, expected %s/%s", reason.Reason, reason.Signal, c.reason, c.signal)
+            }
+            if reason.ExitCode != c.state.ExitCode {
+                test.Errorf("classifyExit() returned exit code %d, expected %d", reason.ExitCode, c.state.ExitCode)
+            }
+        })
+    }
+}
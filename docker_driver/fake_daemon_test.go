@@ -0,0 +1,137 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver_test
+
+import (
+    "io/ioutil"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+const slowStatsDelay = 200 * time.Millisecond
+
+// Minimal stand-in for the Docker daemon, serving canned stats responses
+// Counts open connections so tests can catch leaked response bodies
+// Other endpoints can be served by registering a route
+type fakeDaemon struct {
+    server *httptest.Server
+    oldHost string
+    done chan struct{}
+
+    mu sync.Mutex
+    openConns int
+    routes map[string]http.HandlerFunc
+}
+
+func newFakeDaemon(test *testing.T) *fakeDaemon {
+    statsFixture, err := ioutil.ReadFile("testdata/stats_cgroup_v1.json")
+    if err != nil {
+        test.Fatalf("ReadFile() failed with error:\n%v", err)
+    }
+
+    daemon := &fakeDaemon{done: make(chan struct{}), routes: make(map[string]http.HandlerFunc)}
+    daemon.server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("API-Version", "1.40")
+        if route := daemon.route(r.URL.Path); route != nil {
+            route(w, r)
+            return
+        }
+        switch {
+        case r.URL.Path == "/_ping":
+            w.Write([]byte("OK"))
+        case strings.HasSuffix(r.URL.Path, "/info"):
+            w.Write([]byte(`{"CgroupVersion": "1"}`))
+        case strings.Contains(r.URL.Path, "/containers/missing/"):
+            w.WriteHeader(http.StatusNotFound)
+            w.Write([]byte(`{"message": "No such container: missing"}`))
+        case strings.HasSuffix(r.URL.Path, "/containers/running/stats"):
+            // Hold the body open after the sample so that only closing it,
+            // not decoding it, releases the connection
+            w.Write(statsFixture)
+            w.(http.Flusher).Flush()
+            select {
+            case <-r.Context().Done():
+            case <-daemon.done:
+            }
+        case strings.Contains(r.URL.Path, "/containers/slow") && strings.HasSuffix(r.URL.Path, "/stats"):
+            // Stand-in for the daemon's one second CPU sampling delay
+            time.Sleep(slowStatsDelay)
+            w.Write(statsFixture)
+        case strings.HasSuffix(r.URL.Path, "/containers/stopped/stats"):
+            w.Write([]byte(`{"read": "0001-01-01T00:00:00Z", "id": "stopped"}`))
+        case strings.HasSuffix(r.URL.Path, "/containers/stopped/json"):
+            w.Write([]byte(`{"Id": "stopped", "State": {"Status": "exited", "Running": false}}`))
+        case strings.HasSuffix(r.URL.Path, "/containers/garbled/stats"):
+            w.Write([]byte(`{"read": `))
+        case strings.HasSuffix(r.URL.Path, "/containers/empty/stats"):
+            // No body at all
+        default:
+            w.WriteHeader(http.StatusNotImplemented)
+        }
+    }))
+    daemon.server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+        daemon.mu.Lock()
+        defer daemon.mu.Unlock()
+        switch state {
+        case http.StateNew:
+            daemon.openConns++
+        case http.StateClosed, http.StateHijacked:
+            daemon.openConns--
+        }
+    }
+    daemon.server.Start()
+
+    // Point the driver's clients at the fake daemon
+    daemon.oldHost = os.Getenv("DOCKER_HOST")
+    os.Setenv("DOCKER_HOST", "tcp://" + daemon.server.Listener.Addr().String())
+
+    return daemon
+}
+
+// Serve requests whose path ends in suffix with handler
+func (daemon *fakeDaemon) handle(suffix string, handler http.HandlerFunc) {
+    daemon.mu.Lock()
+    defer daemon.mu.Unlock()
+    daemon.routes[suffix] = handler
+}
+
+func (daemon *fakeDaemon) route(path string) http.HandlerFunc {
+    daemon.mu.Lock()
+    defer daemon.mu.Unlock()
+    for suffix, handler := range daemon.routes {
+        if strings.HasSuffix(path, suffix) {
+            return handler
+        }
+    }
+    return nil
+}
+
+func (daemon *fakeDaemon) conns() int {
+    daemon.mu.Lock()
+    defer daemon.mu.Unlock()
+    return daemon.openConns
+}
+
+func (daemon *fakeDaemon) close() {
+    os.Setenv("DOCKER_HOST", daemon.oldHost)
+    close(daemon.done)
+    daemon.server.Close()
+}
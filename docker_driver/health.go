@@ -0,0 +1,154 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver
+
+import (
+    "time"
+
+    "github.com/docker/docker/api/types"
+    "github.com/docker/docker/api/types/container"
+    "github.com/docker/docker/client"
+    "golang.org/x/net/context"
+)
+
+// Restart policy names understood by the daemon
+const (
+    RestartNo = "no"
+    RestartOnFailure = "on-failure"
+    RestartAlways = "always"
+    RestartUnlessStopped = "unless-stopped"
+)
+
+// Health states reported by GetHealthStatus
+const (
+    HealthNone = types.NoHealthcheck
+    HealthStarting = types.Starting
+    HealthHealthy = types.Healthy
+    HealthUnhealthy = types.Unhealthy
+)
+
+// Daemon-side restart policy
+// Empty Name is the same as RestartNo
+type RestartPolicy struct {
+    Name string
+    MaxRetries int      // only valid with RestartOnFailure, 0 means retry forever
+}
+
+// Daemon-side health check, overrides the image's HEALTHCHECK
+// Empty Cmd disables the image's health check
+// Zero durations and retries inherit the image's (or daemon's) defaults
+type HealthCheck struct {
+    Cmd []string        // exec form, run directly without a shell
+    Interval time.Duration
+    Timeout time.Duration
+    StartPeriod time.Duration
+    Retries int
+}
+
+func (policy RestartPolicy) toDocker() (container.RestartPolicy, error) {
+    verr := &ValidationError{}
+    policy.validate(verr)
+    if len(verr.Violations) > 0 {
+        return container.RestartPolicy{}, verr
+    }
+    return container.RestartPolicy{Name: policy.Name, MaximumRetryCount: policy.MaxRetries}, nil
+}
+
+// Shared by DockerConfig.Validate and toDocker
+func (policy RestartPolicy) validate(verr *ValidationError) {
+    switch policy.Name {
+    case "", RestartNo, RestartAlways, RestartUnlessStopped:
+        if policy.MaxRetries != 0 {
+            verr.add("RestartPolicy.MaxRetries", "only valid with the %s restart policy", RestartOnFailure)
+        }
+    case RestartOnFailure:
+        if policy.MaxRetries < 0 {
+            verr.add("RestartPolicy.MaxRetries", "%d cannot be negative", policy.MaxRetries)
+        }
+    default:
+        verr.add("RestartPolicy.Name", "unknown restart policy %q", policy.Name)
+    }
+}
+
+// nil check means inherit the image's HEALTHCHECK
+func (check *HealthCheck) toDocker() (*container.HealthConfig, error) {
+    if check == nil {
+        return nil, nil
+    }
+
+    verr := &ValidationError{}
+    check.validate(verr)
+    if len(verr.Violations) > 0 {
+        return nil, verr
+    }
+
+    test := []string{"NONE"}
+    if len(check.Cmd) > 0 {
+        test = append([]string{"CMD"}, check.Cmd...)
+    }
+
+    return &container.HealthConfig{
+        Test: test,
+        Interval: check.Interval,
+        Timeout: check.Timeout,
+        StartPeriod: check.StartPeriod,
+        Retries: check.Retries,
+    }, nil
+}
+
+// Shared by DockerConfig.Validate and toDocker, nil is valid
+func (check *HealthCheck) validate(verr *ValidationError) {
+    if check == nil {
+        return
+    }
+    durations := []struct {
+        field string
+        value time.Duration
+    }{
+        {"HealthCheck.Interval", check.Interval},
+        {"HealthCheck.Timeout", check.Timeout},
+        {"HealthCheck.StartPeriod", check.StartPeriod},
+    }
+    for _, duration := range durations {
+        if duration.value < 0 {
+            verr.add(duration.field, "%v cannot be negative", duration.value)
+        }
+    }
+    if check.Retries < 0 {
+        verr.add("HealthCheck.Retries", "%d cannot be negative", check.Retries)
+    }
+}
+
+// Get the daemon's health status for a container
+// Returns one of HealthNone, HealthStarting, HealthHealthy or HealthUnhealthy
+func GetHealthStatus(cont string) (string, error) {
+    ctx := context.Background()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return "", err
+    }
+    defer cli.Close()
+
+    info, err := cli.ContainerInspect(ctx, cont)
+    if err != nil {
+        return "", err
+    }
+
+    if info.State == nil || info.State.Health == nil {
+        return HealthNone, nil
+    }
+
+    return info.State.Health.Status, nil
+}
@@ -0,0 +1,349 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver
+
+import (
+    "reflect"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/docker/docker/api/types"
+    "github.com/docker/docker/api/types/filters"
+    "github.com/docker/docker/client"
+    "golang.org/x/net/context"
+)
+
+// Container states
+const (
+    StateCreated = "created"
+    StateRunning = "running"
+    StatePaused = "paused"
+    StateRestarting = "restarting"
+    StateRemoving = "removing"
+    StateExited = "exited"
+    StateDead = "dead"
+)
+
+// How often to retry containers whose inspect failed, e.g. while the daemon restarts
+const informerRetryInterval = time.Second
+
+// Cached view of a container
+type ContainerInfo struct {
+    ID string
+    Name string
+    Image string
+    Labels map[string]string
+    State string    // one of the State* constants
+    Health string   // one of the Health* constants
+}
+
+// Callbacks for changes to the informer's cache
+// Any of them may be nil; they are called one at a time, in order
+type ContainerHandler struct {
+    OnAdd func(cont ContainerInfo)
+    OnUpdate func(old, cont ContainerInfo)
+    OnDelete func(cont ContainerInfo)
+}
+
+// Options for NewContainerInformer
+type InformerOptions struct {
+    Labels []string         // only cache containers with these labels, "key" or "key=value"
+    Resync time.Duration    // how often to re-list containers to correct drift, 0 never
+}
+
+// Local cache of containers, kept current from the daemon's event stream
+// Call Run to start it; reads are safe from any goroutine
+type ContainerInformer struct {
+    opts InformerOptions
+
+    mu sync.RWMutex
+    containers map[string]ContainerInfo
+    handlers []ContainerHandler
+
+    synced chan struct{}
+    syncOnce sync.Once
+
+    // Only touched by Run
+    dirty map[string]bool   // containers to inspect again
+    stale bool              // last resync failed, list again
+}
+
+func NewContainerInformer(opts InformerOptions) *ContainerInformer {
+    return &ContainerInformer{
+        opts: opts,
+        containers: make(map[string]ContainerInfo),
+        synced: make(chan struct{}),
+        dirty: make(map[string]bool),
+    }
+}
+
+// Register callbacks, must be called before Run
+func (informer *ContainerInformer) AddHandler(handler ContainerHandler) {
+    informer.mu.Lock()
+    defer informer.mu.Unlock()
+    informer.handlers = append(informer.handlers, handler)
+}
+
+// Block until the initial list has been loaded or ctx is done
+func (informer *ContainerInformer) WaitForSync(ctx context.Context) bool {
+    select {
+    case <-informer.synced:
+        return true
+    case <-ctx.Done():
+        return false
+    }
+}
+
+// Look up a cached container by ID or name
+func (informer *ContainerInformer) Get(cont string) (ContainerInfo, bool) {
+    informer.mu.RLock()
+    defer informer.mu.RUnlock()
+
+    if info, ok := informer.containers[cont]; ok {
+        return info, true
+    }
+    name := strings.TrimPrefix(cont, "/")
+    for _, info := range informer.containers {
+        if info.Name == name {
+            return info, true
+        }
+    }
+    return ContainerInfo{}, false
+}
+
+// List cached containers carrying all the given labels
+// An empty value matches any value of that label, nil selector lists everything
+func (informer *ContainerInformer) List(selector map[string]string) []ContainerInfo {
+    informer.mu.RLock()
+    defer informer.mu.RUnlock()
+
+    var list []ContainerInfo
+    for _, info := range informer.containers {
+        if matchLabels(info.Labels, selector) {
+            list = append(list, info)
+        }
+    }
+    return list
+}
+
+func matchLabels(labels, selector map[string]string) bool {
+    for key, value := range selector {
+        actual, ok := labels[key]
+        if !ok || (value != "" && actual != value) {
+            return false
+        }
+    }
+    return true
+}
+
+// Load the cache and keep it current until ctx is cancelled
+// Failed lookups after the initial list are retried rather than stopping the informer
+// Returns nil on cancellation, otherwise the error that stopped the informer
+func (informer *ContainerInformer) Run(ctx context.Context) error {
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return err
+    }
+    defer cli.Close()
+
+    // Subscribe before listing so that no change falls between the two
+    events, errs := SubscribeEvents(ctx, EventOptions{
+        Filter: EventFilter{Types: []string{EventTypeContainer}, Labels: informer.opts.Labels},
+    })
+
+    err = informer.resync(ctx, cli)
+    if err != nil {
+        return err
+    }
+    informer.syncOnce.Do(func() { close(informer.synced) })
+
+    var resyncC <-chan time.Time
+    if informer.opts.Resync > 0 {
+        ticker := time.NewTicker(informer.opts.Resync)
+        defer ticker.Stop()
+        resyncC = ticker.C
+    }
+
+    retry := time.NewTicker(informerRetryInterval)
+    defer retry.Stop()
+
+    for {
+        select {
+        case event, ok := <-events:
+            if !ok {
+                if ctx.Err() != nil {
+                    return nil
+                }
+                return <-errs
+            }
+            informer.handleEvent(ctx, cli, event)
+        case <-resyncC:
+            informer.stale = informer.resync(ctx, cli) != nil
+        case <-retry.C:
+            if informer.stale {
+                informer.stale = informer.resync(ctx, cli) != nil
+            }
+            for id := range informer.dirty {
+                informer.handleEvent(ctx, cli, Event{ID: id})
+            }
+        case <-ctx.Done():
+            return nil
+        }
+    }
+}
+
+// Replace the cache with a fresh list from the daemon
+func (informer *ContainerInformer) resync(ctx context.Context, cli *client.Client) error {
+    args := filters.NewArgs()
+    for _, label := range informer.opts.Labels {
+        args.Add("label", label)
+    }
+    containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: args})
+    if err != nil {
+        return err
+    }
+
+    // A fresh list covers anything waiting to be inspected again
+    informer.dirty = make(map[string]bool)
+    current := make(map[string]bool, len(containers))
+    for _, container := range containers {
+        current[container.ID] = true
+        informer.upsert(containerInfoFromList(container))
+    }
+
+    informer.mu.RLock()
+    var stale []string
+    for id := range informer.containers {
+        if !current[id] {
+            stale = append(stale, id)
+        }
+    }
+    informer.mu.RUnlock()
+
+    for _, id := range stale {
+        informer.remove(id)
+    }
+    return nil
+}
+
+// Containers that cannot be inspected right now are marked dirty and retried
+func (informer *ContainerInformer) handleEvent(ctx context.Context, cli *client.Client, event Event) {
+    if event.Action == EventDestroy {
+        delete(informer.dirty, event.ID)
+        informer.remove(event.ID)
+        return
+    }
+    // exec events do not change the container itself
+    if strings.HasPrefix(event.Action, "exec_") {
+        return
+    }
+
+    info, err := cli.ContainerInspect(ctx, event.ID)
+    if client.IsErrNotFound(err) {
+        delete(informer.dirty, event.ID)
+        informer.remove(event.ID)
+        return
+    }
+    if err != nil {
+        informer.dirty[event.ID] = true
+        return
+    }
+
+    delete(informer.dirty, event.ID)
+    informer.upsert(containerInfoFromInspect(info))
+}
+
+func (informer *ContainerInformer) upsert(info ContainerInfo) {
+    informer.mu.Lock()
+    old, exists := informer.containers[info.ID]
+    informer.containers[info.ID] = info
+    handlers := informer.handlers
+    informer.mu.Unlock()
+
+    for _, handler := range handlers {
+        if !exists && handler.OnAdd != nil {
+            handler.OnAdd(info)
+        } else if exists && handler.OnUpdate != nil && !reflect.DeepEqual(old, info) {
+            handler.OnUpdate(old, info)
+        }
+    }
+}
+
+func (informer *ContainerInformer) remove(id string) {
+    informer.mu.Lock()
+    old, exists := informer.containers[id]
+    delete(informer.containers, id)
+    handlers := informer.handlers
+    informer.mu.Unlock()
+
+    if !exists {
+        return
+    }
+    for _, handler := range handlers {
+        if handler.OnDelete != nil {
+            handler.OnDelete(old)
+        }
+    }
+}
+
+func containerInfoFromList(container types.Container) ContainerInfo {
+    info := ContainerInfo{
+        ID: container.ID,
+        Image: container.Image,
+        Labels: container.Labels,
+        State: container.State,
+        Health: healthFromStatus(container.Status),
+    }
+    if len(container.Names) > 0 {
+        info.Name = strings.TrimPrefix(container.Names[0], "/")
+    }
+    return info
+}
+
+func containerInfoFromInspect(container types.ContainerJSON) ContainerInfo {
+    info := ContainerInfo{Health: HealthNone}
+    if container.ContainerJSONBase != nil {
+        info.ID = container.ID
+        info.Name = strings.TrimPrefix(container.Name, "/")
+        if container.State != nil {
+            info.State = container.State.Status
+            if container.State.Health != nil {
+                info.Health = container.State.Health.Status
+            }
+        }
+    }
+    if container.Config != nil {
+        info.Image = container.Config.Image
+        info.Labels = container.Config.Labels
+    }
+    return info
+}
+
+// Container lists only carry health in the status text, e.g. "Up 5 minutes (healthy)"
+func healthFromStatus(status string) string {
+    switch {
+    case strings.HasSuffix(status, "(health: starting)"):
+        return HealthStarting
+    case strings.HasSuffix(status, "(healthy)"):
+        return HealthHealthy
+    case strings.HasSuffix(status, "(unhealthy)"):
+        return HealthUnhealthy
+    }
+    return HealthNone
+}
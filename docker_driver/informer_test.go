@@ -0,0 +1,171 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver_test
+
+import (
+    "context"
+    "net/http"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    driver "github.com/PhysarumSM/docker-driver/docker_driver"
+)
+
+func TestContainerInformer(test *testing.T) {
+    daemon := newFakeDaemon(test)
+    defer daemon.close()
+
+    daemon.handle("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(`[
+            {"Id": "abc", "Names": ["/web"], "Image": "busybox", "Labels": {"app": "web"}, "State": "running", "Status": "Up 5 minutes (healthy)"},
+            {"Id": "def", "Names": ["/db"], "Image": "busybox", "Labels": {"app": "db"}, "State": "exited", "Status": "Exited (0) 1 minute ago"}
+        ]`))
+    })
+    daemon.handle("/containers/abc/json", func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(`{"Id": "abc", "Name": "/web", "State": {"Status": "exited", "ExitCode": 137},
+            "Config": {"Image": "busybox", "Labels": {"app": "web"}}}`))
+    })
+    release := make(chan struct{})
+    daemon.handle("/events", func(w http.ResponseWriter, r *http.Request) {
+        // Hold events back until the initial list has been loaded
+        select {
+        case <-release:
+        case <-r.Context().Done():
+            return
+        }
+        w.Write([]byte(`{"Type": "container", "Action": "die", "Actor": {"ID": "abc"}, "timeNano": 1597946532000000001}` + "\n" +
+            `{"Type": "container", "Action": "destroy", "Actor": {"ID": "def"}, "timeNano": 1597946533000000001}` + "\n"))
+        w.(http.Flusher).Flush()
+        <-r.Context().Done()
+    })
+
+    added := make(chan driver.ContainerInfo, 10)
+    updated := make(chan driver.ContainerInfo, 10)
+    deleted := make(chan driver.ContainerInfo, 10)
+
+    informer := driver.NewContainerInformer(driver.InformerOptions{})
+    informer.AddHandler(driver.ContainerHandler{
+        OnAdd: func(cont driver.ContainerInfo) { added <- cont },
+        OnUpdate: func(old, cont driver.ContainerInfo) { updated <- cont },
+        OnDelete: func(cont driver.ContainerInfo) { deleted <- cont },
+    })
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    runErr := make(chan error, 1)
+    go func() { runErr <- informer.Run(ctx) }()
+
+    syncCtx, syncCancel := context.WithTimeout(ctx, 5 * time.Second)
+    defer syncCancel()
+    if !informer.WaitForSync(syncCtx) {
+        test.Fatalf("WaitForSync() timed out")
+    }
+
+    test.Run("initial-list", func(test *testing.T) {
+        if len(added) != 2 {
+            test.Errorf("OnAdd called %d times, expected 2", len(added))
+        }
+        web, ok := informer.Get("web")
+        if !ok || web.State != "running" || web.Health != driver.HealthHealthy {
+            test.Errorf("Get() returned %+v, expected running and healthy", web)
+        }
+        if list := informer.List(map[string]string{"app": "web"}); len(list) != 1 || list[0].ID != "abc" {
+            test.Errorf("List() returned %+v, expected only container (abc)", list)
+        }
+    })
+
+    close(release)
+
+    test.Run("events", func(test *testing.T) {
+        select {
+        case cont := <-updated:
+            if cont.ID != "abc" || cont.State != "exited" {
+                test.Errorf("OnUpdate called with %+v, expected container (abc) exited", cont)
+            }
+        case <-time.After(5 * time.Second):
+            test.Fatalf("OnUpdate not called for die event")
+        }
+
+        select {
+        case cont := <-deleted:
+            if cont.ID != "def" {
+                test.Errorf("OnDelete called with %+v, expected container (def)", cont)
+            }
+        case <-time.After(5 * time.Second):
+            test.Fatalf("OnDelete not called for destroy event")
+        }
+
+        if _, ok := informer.Get("def"); ok {
+            test.Errorf("Get() found destroyed container (def)")
+        }
+    })
+
+    cancel()
+    if err := <-runErr; err != nil {
+        test.Errorf("Run() returned:\n%v", err)
+    }
+}
+
+func TestContainerInformerInspectRetry(test *testing.T) {
+    daemon := newFakeDaemon(test)
+    defer daemon.close()
+
+    daemon.handle("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(`[]`))
+    })
+    var inspects int32
+    daemon.handle("/containers/abc/json", func(w http.ResponseWriter, r *http.Request) {
+        // Daemon still coming back from a restart on the first try
+        if atomic.AddInt32(&inspects, 1) == 1 {
+            w.WriteHeader(http.StatusInternalServerError)
+            w.Write([]byte(`{"message": "daemon is restarting"}`))
+            return
+        }
+        w.Write([]byte(`{"Id": "abc", "Name": "/web", "State": {"Status": "running"}, "Config": {"Image": "busybox"}}`))
+    })
+    daemon.handle("/events", func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(`{"Type": "container", "Action": "start", "Actor": {"ID": "abc"}, "timeNano": 1597946532000000001}` + "\n"))
+        w.(http.Flusher).Flush()
+        <-r.Context().Done()
+    })
+
+    added := make(chan driver.ContainerInfo, 1)
+    informer := driver.NewContainerInformer(driver.InformerOptions{})
+    informer.AddHandler(driver.ContainerHandler{
+        OnAdd: func(cont driver.ContainerInfo) { added <- cont },
+    })
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    runErr := make(chan error, 1)
+    go func() { runErr <- informer.Run(ctx) }()
+
+    select {
+    case cont := <-added:
+        if cont.ID != "abc" || cont.State != driver.StateRunning {
+            test.Errorf("OnAdd called with %+v, expected container (abc) running", cont)
+        }
+    case err := <-runErr:
+        test.Fatalf("Run() stopped on a failed inspect:\n%v", err)
+    case <-time.After(5 * time.Second):
+        test.Fatalf("OnAdd not called after the inspect was retried")
+    }
+
+    cancel()
+    if err := <-runErr; err != nil {
+        test.Errorf("Run() returned:\n%v", err)
+    }
+}
@@ -0,0 +1,154 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "time"
+
+    "github.com/docker/docker/api/types"
+    "github.com/docker/docker/api/types/filters"
+    "github.com/docker/docker/client"
+    "golang.org/x/net/context"
+)
+
+// Labels stamped by RunContainer on every container it creates
+// Used to tell our containers apart from anything else running on the host
+const (
+    LabelManagedBy = "com.physarumsm.managed-by"
+    LabelCreated = "com.physarumsm.created"
+    LabelConfigHash = "com.physarumsm.config-hash"
+
+    // Value of LabelManagedBy for containers launched by this driver
+    ManagedByValue = "docker-driver"
+)
+
+// Hash of a DockerConfig, as stamped in LabelConfigHash on the containers created from it
+// Compare it with a container's label to detect containers whose config has since changed
+// Name is left out, so that ContainerPool's containers, renamed on Acquire, match as well
+func ConfigHash(opt DockerConfig) (string, error) {
+    opt.Name = ""
+    encoded, err := json.Marshal(opt)
+    if err != nil {
+        return "", err
+    }
+
+    sum := sha256.Sum256(encoded)
+    return hex.EncodeToString(sum[:]), nil
+}
+
+// Merge caller-supplied labels with the driver's ownership labels
+// Driver labels win so that callers cannot spoof or drop ownership
+// extra labels are added after hashing, so they do not change LabelConfigHash
+func containerLabels(opt DockerConfig, extra map[string]string) (map[string]string, error) {
+    hash, err := ConfigHash(opt)
+    if err != nil {
+        return nil, err
+    }
+
+    labels := make(map[string]string, len(opt.Labels) + len(extra) + 3)
+    for key, value := range opt.Labels {
+        labels[key] = value
+    }
+    for key, value := range extra {
+        labels[key] = value
+    }
+    labels[LabelManagedBy] = ManagedByValue
+    labels[LabelCreated] = time.Now().UTC().Format(time.RFC3339)
+    labels[LabelConfigHash] = hash
+
+    return labels, nil
+}
+
+// List IDs of all containers launched by this driver, running or not
+func ListManagedContainers() ([]string, error) {
+    ctx := context.Background()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return nil, err
+    }
+    defer cli.Close()
+
+    containers, err := cli.ContainerList(ctx, types.ContainerListOptions{
+        All: true,
+        Filters: filters.NewArgs(filters.Arg("label", LabelManagedBy + "=" + ManagedByValue)),
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    var clist []string
+    for _, container := range containers {
+        clist = append(clist, container.ID)
+    }
+
+    return clist, nil
+}
+
+// Remove managed containers that the caller does not know about
+// known holds the container IDs or names the caller is still tracking,
+// including the warm containers of any ContainerPool in use, see ContainerPool.Warm
+// Returns the IDs of the containers that were removed
+func RemoveOrphanContainers(known []string) ([]string, error) {
+    ctx := context.Background()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return nil, err
+    }
+    defer cli.Close()
+
+    containers, err := cli.ContainerList(ctx, types.ContainerListOptions{
+        All: true,
+        Filters: filters.NewArgs(filters.Arg("label", LabelManagedBy + "=" + ManagedByValue)),
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    knownSet := make(map[string]bool, len(known))
+    for _, cont := range known {
+        knownSet[cont] = true
+    }
+
+    var removed []string
+    for _, container := range containers {
+        if isKnownContainer(knownSet, container) {
+            continue
+        }
+
+        err = cli.ContainerRemove(ctx, container.ID, types.ContainerRemoveOptions{Force: true})
+        if err != nil {
+            return removed, err
+        }
+        removed = append(removed, container.ID)
+    }
+
+    return removed, nil
+}
+
+// Docker reports names with a leading "/"
+func isKnownContainer(knownSet map[string]bool, container types.Container) bool {
+    if knownSet[container.ID] {
+        return true
+    }
+    for _, name := range container.Names {
+        if knownSet[name] || (len(name) > 0 && knownSet[name[1:]]) {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,112 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver
+
+import (
+    "bytes"
+    "io"
+    "strconv"
+
+    "github.com/docker/docker/api/types"
+    "github.com/docker/docker/client"
+    "github.com/docker/docker/pkg/stdcopy"
+    "golang.org/x/net/context"
+)
+
+// Options for GetLogs and FollowLogs
+// Since and Until take an RFC3339 timestamp, a unix timestamp or a
+// duration relative to now (e.g. "10m"), same as `docker logs`
+type LogOptions struct {
+    Since string
+    Until string
+    Tail int            // number of lines from the end, 0 means all
+    Timestamps bool     // prefix each line with its RFC3339Nano timestamp
+}
+
+func (opts LogOptions) toDocker(follow bool) types.ContainerLogsOptions {
+    tail := "all"
+    if opts.Tail > 0 {
+        tail = strconv.Itoa(opts.Tail)
+    }
+
+    return types.ContainerLogsOptions{
+        ShowStdout: true,
+        ShowStderr: true,
+        Since: opts.Since,
+        Until: opts.Until,
+        Tail: tail,
+        Timestamps: opts.Timestamps,
+        Follow: follow,
+    }
+}
+
+// Get a container's logs
+// TTY containers have no separate stderr, all their output is returned in stdout
+func GetLogs(cont string, opts LogOptions) (stdout string, stderr string, err error) {
+    ctx := context.Background()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return "", "", err
+    }
+    defer cli.Close()
+
+    var outBuf, errBuf bytes.Buffer
+    err = copyLogs(ctx, cli, cont, opts.toDocker(false), &outBuf, &errBuf)
+    if err != nil {
+        return "", "", err
+    }
+
+    return outBuf.String(), errBuf.String(), nil
+}
+
+// Stream a container's logs into stdout and stderr as they are written
+// Blocks until the container stops or ctx is cancelled
+// TTY containers have no separate stderr, all their output goes to stdout
+func FollowLogs(ctx context.Context, cont string, opts LogOptions, stdout, stderr io.Writer) error {
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return err
+    }
+    defer cli.Close()
+
+    err = copyLogs(ctx, cli, cont, opts.toDocker(true), stdout, stderr)
+    if err != nil && ctx.Err() != nil {
+        // Cancellation is how callers stop following, not a failure
+        return nil
+    }
+    return err
+}
+
+// Copy logs out of the daemon, demultiplexing them unless the container has a TTY
+// TTY containers send a raw stream, others send stdcopy frames
+func copyLogs(ctx context.Context, cli *client.Client, cont string, options types.ContainerLogsOptions, stdout, stderr io.Writer) error {
+    info, err := cli.ContainerInspect(ctx, cont)
+    if err != nil {
+        return err
+    }
+
+    resp, err := cli.ContainerLogs(ctx, cont, options)
+    if err != nil {
+        return err
+    }
+    defer resp.Close()
+
+    if info.Config != nil && info.Config.Tty {
+        _, err = io.Copy(stdout, resp)
+    } else {
+        _, err = stdcopy.StdCopy(stdout, stderr, resp)
+    }
+    return err
+}
@@ -0,0 +1,389 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver
+
+import (
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "path"
+    "strings"
+    "sync"
+
+    "github.com/docker/distribution/reference"
+    "github.com/docker/docker/api/types/container"
+    "github.com/docker/docker/api/types/mount"
+    "github.com/docker/docker/client"
+    "golang.org/x/net/context"
+    "gopkg.in/yaml.v2"
+)
+
+// Operations a Policy is asked to admit
+const (
+    OperationPull = "pull"          // PullImage
+    OperationCreate = "create"      // RunContainer, CreateContainer and ContainerPool
+    OperationResize = "resize"      // ResizeContainer and ResizeContainerWithResources
+)
+
+// CFS period in microseconds the daemon uses when only a quota is given
+const defaultCPUPeriod = 100000
+
+// apiVersion of the policy file format read by ParsePolicy
+const PolicyAPIVersion = "policy.docker-driver.physarumsm/v1"
+
+// Policy consulted before every operation, nil admits everything
+var admission = struct {
+    sync.RWMutex
+    policy Policy
+}{}
+
+// What a Policy is asked to admit
+type AdmissionRequest struct {
+    Operation string                    // one of the Operation* constants
+    Image string                        // pull and create
+    Container string                    // resize
+    Config *DockerConfig                // create
+    HostConfig *container.HostConfig    // create, as it will be sent to the daemon; resize with only Resources set, the update merged over the current limits
+}
+
+// One rule a request broke
+type PolicyViolation struct {
+    Rule string         // e.g. "maxMemory"
+    Message string
+}
+
+// Returned when the policy refuses an operation
+type PolicyDeniedError struct {
+    Operation string
+    Violations []PolicyViolation
+}
+
+func (err *PolicyDeniedError) Error() string {
+    msgs := make([]string, len(err.Violations))
+    for i, violation := range err.Violations {
+        msgs[i] = violation.Rule + ": " + violation.Message
+    }
+    return "docker_driver: Error " + err.Operation + " denied by policy: " + strings.Join(msgs, "; ")
+}
+
+// Decides whether the driver may carry out a request
+// Admit returns every rule the request breaks, or nothing to allow it
+type Policy interface {
+    Admit(req AdmissionRequest) []PolicyViolation
+}
+
+// Set the policy every pull, create and resize must pass, nil turns admission off
+// Containers that already exist are not checked again, except a ContainerPool's
+// warm ones, which are checked before Acquire hands them out
+func SetPolicy(policy Policy) {
+    admission.Lock()
+    defer admission.Unlock()
+    admission.policy = policy
+}
+
+func currentPolicy() Policy {
+    admission.RLock()
+    defer admission.RUnlock()
+    return admission.policy
+}
+
+// Ask the current policy about req
+func admit(req AdmissionRequest) error {
+    return admitWith(currentPolicy(), req)
+}
+
+func admitWith(policy Policy, req AdmissionRequest) error {
+    if policy == nil {
+        return nil
+    }
+    violations := policy.Admit(req)
+    if len(violations) > 0 {
+        return &PolicyDeniedError{Operation: req.Operation, Violations: violations}
+    }
+    return nil
+}
+
+// Ask the current policy about resizing cont with update
+// An update only carries the fields it changes, so the policy is shown the
+// limits the container will end up with rather than the update on its own
+func admitResize(ctx context.Context, cli *client.Client, cont string, update container.Resources) error {
+    policy := currentPolicy()
+    if policy == nil {
+        return nil
+    }
+
+    info, err := cli.ContainerInspect(ctx, cont)
+    if err != nil {
+        return err
+    }
+    var current container.Resources
+    if info.HostConfig != nil {
+        current = info.HostConfig.Resources
+    }
+    resources := mergeResources(current, update)
+    return admitWith(policy, AdmissionRequest{Operation: OperationResize, Container: cont, HostConfig: &container.HostConfig{Resources: resources}})
+}
+
+// The memory and CPU limits a container has after applying update to current
+func mergeResources(current, update container.Resources) container.Resources {
+    merged := update
+    if merged.Memory == 0 {
+        merged.Memory = current.Memory
+    }
+    switch {
+    case update.NanoCPUs == 0 && update.CPUPeriod == 0 && update.CPUQuota == 0:
+        merged.NanoCPUs = current.NanoCPUs
+        merged.CPUPeriod = current.CPUPeriod
+        merged.CPUQuota = current.CPUQuota
+    case update.NanoCPUs == 0:
+        // The daemon keeps whichever of period and quota the update leaves out
+        if merged.CPUPeriod == 0 {
+            merged.CPUPeriod = current.CPUPeriod
+        }
+        if merged.CPUQuota == 0 {
+            merged.CPUQuota = current.CPUQuota
+        }
+    }
+    return merged
+}
+
+// Declarative Policy, usually read from a policy file with LoadPolicyFile
+// Zero values leave that rule off
+type RulePolicy struct {
+    AllowedRegistries []string      // e.g. "docker.io" or "registry.example.com:5000"
+    AllowedImages []string          // path.Match patterns on the short or full name, e.g. "busybox" or "docker.io/myorg/*"
+    RequireDigest bool              // images must be pinned as name@sha256:digest
+    MaxMemory int64                 // bytes per container, containers must set a Memory limit
+    MaxCpu float64                  // cores per container, containers must set a Cpu limit
+    ForbidPrivileged bool           // privileged, unconfined seccomp or AppArmor, and host namespaces
+    ForbiddenCapabilities []string  // capabilities that cannot be added, "ALL" forbids adding any
+    ForbiddenHostPaths []string     // host paths that cannot be mounted, nor anything under them
+}
+
+func (policy *RulePolicy) Admit(req AdmissionRequest) []PolicyViolation {
+    var violations []PolicyViolation
+    deny := func(rule, format string, args ...interface{}) {
+        violations = append(violations, PolicyViolation{Rule: rule, Message: fmt.Sprintf(format, args...)})
+    }
+
+    if req.Operation == OperationPull || req.Operation == OperationCreate {
+        policy.admitImage(deny, req.Image)
+    }
+    if req.HostConfig != nil {
+        policy.admitResources(deny, req.HostConfig.Resources, req.Operation == OperationResize)
+    }
+    if req.Operation == OperationCreate && req.HostConfig != nil {
+        policy.admitHostConfig(deny, req.HostConfig)
+    }
+    return violations
+}
+
+func (policy *RulePolicy) admitImage(deny func(string, string, ...interface{}), image string) {
+    if len(policy.AllowedRegistries) == 0 && len(policy.AllowedImages) == 0 && !policy.RequireDigest {
+        return
+    }
+
+    named, err := reference.ParseNormalizedNamed(image)
+    if err != nil {
+        deny("image", "%q is not a valid image reference", image)
+        return
+    }
+
+    if len(policy.AllowedRegistries) > 0 && !containsString(policy.AllowedRegistries, reference.Domain(named)) {
+        deny("allowedRegistries", "registry %s of %s is not allowed", reference.Domain(named), image)
+    }
+    if len(policy.AllowedImages) > 0 && !matchesImage(policy.AllowedImages, named) {
+        deny("allowedImages", "image %s is not allowed", image)
+    }
+    if _, ok := named.(reference.Digested); policy.RequireDigest && !ok {
+        deny("requireDigest", "image %s must be pinned by digest", image)
+    }
+}
+
+// On resize the limits are merged with the container's, zero there means it has none
+func (policy *RulePolicy) admitResources(deny func(string, string, ...interface{}), res container.Resources, resize bool) {
+    if policy.MaxMemory > 0 {
+        if res.Memory > policy.MaxMemory {
+            deny("maxMemory", "memory %s is over the limit of %s", FormatMemory(res.Memory), FormatMemory(policy.MaxMemory))
+        } else if res.Memory <= 0 && !resize {
+            deny("maxMemory", "a memory limit of at most %s is required", FormatMemory(policy.MaxMemory))
+        }
+    }
+
+    if policy.MaxCpu > 0 {
+        cpu := float64(res.NanoCPUs) / 1e9
+        if res.CPUQuota > 0 {
+            period := res.CPUPeriod
+            if period <= 0 {
+                period = defaultCPUPeriod
+            }
+            cpu = float64(res.CPUQuota) / float64(period)
+        }
+        if cpu > policy.MaxCpu {
+            deny("maxCpu", "CPU %s is over the limit of %s", FormatCPU(cpu), FormatCPU(policy.MaxCpu))
+        } else if cpu <= 0 && !resize {
+            deny("maxCpu", "a CPU limit of at most %s is required", FormatCPU(policy.MaxCpu))
+        }
+    }
+}
+
+func (policy *RulePolicy) admitHostConfig(deny func(string, string, ...interface{}), hostConfig *container.HostConfig) {
+    if policy.ForbidPrivileged {
+        if hostConfig.Privileged {
+            deny("forbidPrivileged", "privileged containers are not allowed")
+        }
+        for _, opt := range hostConfig.SecurityOpt {
+            if opt == "seccomp=" + ProfileUnconfined || opt == "apparmor=" + ProfileUnconfined {
+                deny("forbidPrivileged", "%s is not allowed", opt)
+            }
+        }
+        namespaces := []struct {
+            name string
+            host bool
+        }{
+            {"network", hostConfig.NetworkMode.IsHost()},
+            {"PID", hostConfig.PidMode.IsHost()},
+            {"IPC", hostConfig.IpcMode.IsHost()},
+            {"UTS", hostConfig.UTSMode.IsHost()},
+            {"user", hostConfig.UsernsMode.IsHost()},
+        }
+        for _, namespace := range namespaces {
+            if namespace.host {
+                deny("forbidPrivileged", "the host %s namespace is not allowed", namespace.name)
+            }
+        }
+    }
+
+    for _, capability := range hostConfig.CapAdd {
+        name := strings.TrimPrefix(strings.ToUpper(capability), "CAP_")
+        for _, forbidden := range policy.ForbiddenCapabilities {
+            forbidden = strings.TrimPrefix(strings.ToUpper(forbidden), "CAP_")
+            if forbidden == "ALL" || forbidden == name {
+                deny("forbiddenCapabilities", "capability %s is not allowed", capability)
+                break
+            }
+        }
+    }
+
+    if len(policy.ForbiddenHostPaths) > 0 {
+        var sources []string
+        for _, bind := range hostConfig.Binds {
+            // Named volumes are not host paths
+            if source := strings.SplitN(bind, ":", 2)[0]; strings.HasPrefix(source, "/") {
+                sources = append(sources, source)
+            }
+        }
+        for _, m := range hostConfig.Mounts {
+            if m.Type == mount.TypeBind {
+                sources = append(sources, m.Source)
+            }
+        }
+        for _, source := range sources {
+            if forbidden, ok := underPath(policy.ForbiddenHostPaths, source); ok {
+                deny("forbiddenHostPaths", "mounting %s is not allowed, it is under %s", source, forbidden)
+            }
+        }
+    }
+}
+
+func containsString(list []string, s string) bool {
+    for _, item := range list {
+        if item == s {
+            return true
+        }
+    }
+    return false
+}
+
+// Patterns match either the short name, e.g. "busybox", or the full one, e.g. "docker.io/library/busybox"
+func matchesImage(patterns []string, named reference.Named) bool {
+    names := []string{reference.FamiliarName(named), named.Name()}
+    for _, pattern := range patterns {
+        for _, name := range names {
+            if ok, _ := path.Match(pattern, name); ok {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// The first of paths that source is, or is under
+func underPath(paths []string, source string) (string, bool) {
+    source = path.Clean(source)
+    for _, p := range paths {
+        p = path.Clean(p)
+        if p == "/" || source == p || strings.HasPrefix(source, p + "/") {
+            return p, true
+        }
+    }
+    return "", false
+}
+
+// Wire format of PolicyAPIVersion, JSON is accepted as well since it is YAML
+type policyV1 struct {
+    APIVersion string `yaml:"apiVersion"`
+    AllowedRegistries []string `yaml:"allowedRegistries,omitempty"`
+    AllowedImages []string `yaml:"allowedImages,omitempty"`
+    RequireDigest bool `yaml:"requireDigest,omitempty"`
+    MaxMemory MemorySize `yaml:"maxMemory,omitempty"`
+    MaxCpu CPUs `yaml:"maxCpu,omitempty"`
+    ForbidPrivileged bool `yaml:"forbidPrivileged,omitempty"`
+    ForbiddenCapabilities []string `yaml:"forbiddenCapabilities,omitempty"`
+    ForbiddenHostPaths []string `yaml:"forbiddenHostPaths,omitempty"`
+}
+
+// Decode a YAML or JSON policy file
+// Unknown fields are rejected, so a misspelt rule does not silently go unenforced
+func ParsePolicy(data []byte) (*RulePolicy, error) {
+    var v1 policyV1
+    if err := yaml.UnmarshalStrict(data, &v1); err != nil {
+        return nil, err
+    }
+    if v1.APIVersion != PolicyAPIVersion {
+        return nil, errors.New("docker_driver: Error unknown policy apiVersion " + v1.APIVersion)
+    }
+
+    for _, p := range v1.ForbiddenHostPaths {
+        if !strings.HasPrefix(p, "/") {
+            return nil, errors.New("docker_driver: Error forbidden host path " + p + " must be absolute")
+        }
+    }
+    for _, pattern := range v1.AllowedImages {
+        if _, err := path.Match(pattern, ""); err != nil {
+            return nil, errors.New("docker_driver: Error invalid image pattern " + pattern)
+        }
+    }
+
+    return &RulePolicy{
+        AllowedRegistries: v1.AllowedRegistries,
+        AllowedImages: v1.AllowedImages,
+        RequireDigest: v1.RequireDigest,
+        MaxMemory: int64(v1.MaxMemory),
+        MaxCpu: float64(v1.MaxCpu),
+        ForbidPrivileged: v1.ForbidPrivileged,
+        ForbiddenCapabilities: v1.ForbiddenCapabilities,
+        ForbiddenHostPaths: v1.ForbiddenHostPaths,
+    }, nil
+}
+
+// Read and decode a policy file, see ParsePolicy
+func LoadPolicyFile(file string) (*RulePolicy, error) {
+    data, err := ioutil.ReadFile(file)
+    if err != nil {
+        return nil, err
+    }
+    return ParsePolicy(data)
+}
@@ -0,0 +1,218 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver_test
+
+import (
+    "errors"
+    "net/http"
+    "reflect"
+    "testing"
+
+    driver "github.com/PhysarumSM/docker-driver/docker_driver"
+    "github.com/docker/docker/api/types/container"
+    "github.com/docker/docker/api/types/mount"
+)
+
+const pinnedBusybox = "busybox@sha256:c3839dd800b9eb7603340509769c43e146a74c63dca3045a8e7dc8ee07e53966"
+
+func TestLoadPolicyFile(test *testing.T) {
+    policy, err := driver.LoadPolicyFile("testdata/policy_v1.yaml")
+    if err != nil {
+        test.Fatalf("LoadPolicyFile() returned:\n%v", err)
+    }
+
+    expected := &driver.RulePolicy{
+        AllowedRegistries: []string{"docker.io", "registry.example.com:5000"},
+        AllowedImages: []string{"busybox", "docker.io/myorg/*", "registry.example.com:5000/*"},
+        RequireDigest: true,
+        MaxMemory: 512 << 20,
+        MaxCpu: 1.5,
+        ForbidPrivileged: true,
+        ForbiddenCapabilities: []string{"SYS_ADMIN", "NET_ADMIN"},
+        ForbiddenHostPaths: []string{"/var/run/docker.sock", "/etc"},
+    }
+    if !reflect.DeepEqual(policy, expected) {
+        test.Errorf("LoadPolicyFile() returned\n%+v\nexpected\n%+v", policy, expected)
+    }
+
+    // Misspelt rules must not be silently dropped
+    bad := []string{
+        "apiVersion: policy.docker-driver.physarumsm/v1\nrequireDigests: true\n",
+        "apiVersion: docker-driver.physarumsm/v1\n",
+        "apiVersion: policy.docker-driver.physarumsm/v1\nforbiddenHostPaths: [etc]\n",
+        `{"apiVersion": "policy.docker-driver.physarumsm/v1", "maxMemory": "lots"}`,
+    }
+    for _, data := range bad {
+        if _, err := driver.ParsePolicy([]byte(data)); err == nil {
+            test.Errorf("ParsePolicy() accepted %q, expected it to fail", data)
+        }
+    }
+}
+
+func TestRulePolicyAdmit(test *testing.T) {
+    policy, err := driver.LoadPolicyFile("testdata/policy_v1.yaml")
+    if err != nil {
+        test.Fatalf("LoadPolicyFile() returned:\n%v", err)
+    }
+
+    limits := container.Resources{Memory: 256 << 20, NanoCPUs: 1e9}
+    cases := []struct {
+        name string
+        req driver.AdmissionRequest
+        rules []string
+    }{
+        {"pull-pinned", driver.AdmissionRequest{Operation: driver.OperationPull, Image: pinnedBusybox}, nil},
+        {"pull-tag", driver.AdmissionRequest{Operation: driver.OperationPull, Image: "busybox:latest"}, []string{"requireDigest"}},
+        {"pull-other", driver.AdmissionRequest{Operation: driver.OperationPull, Image: "quay.io/other/app@sha256:c3839dd800b9eb7603340509769c43e146a74c63dca3045a8e7dc8ee07e53966"},
+            []string{"allowedRegistries", "allowedImages"}},
+        {"pull-invalid", driver.AdmissionRequest{Operation: driver.OperationPull, Image: "Not An Image"}, []string{"image"}},
+        {"create", driver.AdmissionRequest{Operation: driver.OperationCreate, Image: pinnedBusybox,
+            HostConfig: &container.HostConfig{Resources: limits, CapAdd: []string{"NET_BIND_SERVICE"}}}, nil},
+        {"create-unlimited", driver.AdmissionRequest{Operation: driver.OperationCreate, Image: pinnedBusybox,
+            HostConfig: &container.HostConfig{}}, []string{"maxMemory", "maxCpu"}},
+        {"create-privileged", driver.AdmissionRequest{Operation: driver.OperationCreate, Image: pinnedBusybox,
+            HostConfig: &container.HostConfig{
+                Resources: limits,
+                Privileged: true,
+                NetworkMode: "host",
+                SecurityOpt: []string{"seccomp=unconfined"},
+                CapAdd: []string{"cap_sys_admin"},
+            }}, []string{"forbidPrivileged", "forbidPrivileged", "forbidPrivileged", "forbiddenCapabilities"}},
+        {"create-mounts", driver.AdmissionRequest{Operation: driver.OperationCreate, Image: pinnedBusybox,
+            HostConfig: &container.HostConfig{
+                Resources: limits,
+                Binds: []string{"/etc/passwd:/passwd:ro", "data:/data", "/etcetera:/x"},
+                Mounts: []mount.Mount{{Type: mount.TypeBind, Source: "/var/run/docker.sock", Target: "/docker.sock"}},
+            }}, []string{"forbiddenHostPaths", "forbiddenHostPaths"}},
+        {"resize", driver.AdmissionRequest{Operation: driver.OperationResize, Container: "abc",
+            HostConfig: &container.HostConfig{Resources: container.Resources{Memory: 1 << 30}}}, []string{"maxMemory"}},
+        {"resize-quota", driver.AdmissionRequest{Operation: driver.OperationResize, Container: "abc",
+            HostConfig: &container.HostConfig{Resources: container.Resources{CPUQuota: 200000, CPUPeriod: 100000}}}, []string{"maxCpu"}},
+        {"resize-quota-only", driver.AdmissionRequest{Operation: driver.OperationResize, Container: "abc",
+            HostConfig: &container.HostConfig{Resources: container.Resources{CPUQuota: 500000}}}, []string{"maxCpu"}},
+        {"create-quota-only", driver.AdmissionRequest{Operation: driver.OperationCreate, Image: pinnedBusybox,
+            HostConfig: &container.HostConfig{Resources: container.Resources{Memory: 256 << 20, CPUQuota: 50000}}}, nil},
+        {"create-quota-only-over", driver.AdmissionRequest{Operation: driver.OperationCreate, Image: pinnedBusybox,
+            HostConfig: &container.HostConfig{Resources: container.Resources{Memory: 256 << 20, CPUQuota: 200000}}}, []string{"maxCpu"}},
+        {"resize-keep", driver.AdmissionRequest{Operation: driver.OperationResize, Container: "abc",
+            HostConfig: &container.HostConfig{}}, nil},
+    }
+
+    for _, c := range cases {
+        var rules []string
+        for _, violation := range policy.Admit(c.req) {
+            rules = append(rules, violation.Rule)
+        }
+        if !reflect.DeepEqual(rules, c.rules) {
+            test.Errorf("%s: Admit() broke rules %v, expected %v", c.name, rules, c.rules)
+        }
+    }
+}
+
+func TestPolicyDenial(test *testing.T) {
+    daemon := newFakeDaemon(test)
+    defer daemon.close()
+    creates := serveValidate(daemon)
+    pulls := 0
+    daemon.handle("/images/create", func(w http.ResponseWriter, r *http.Request) {
+        pulls++
+        w.WriteHeader(http.StatusInternalServerError)
+    })
+    daemon.handle("/containers/abc/json", func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(`{"Id": "abc", "HostConfig": {"Memory": 33554432}}`))
+    })
+    updates := 0
+    daemon.handle("/update", func(w http.ResponseWriter, r *http.Request) {
+        updates++
+        w.WriteHeader(http.StatusInternalServerError)
+    })
+
+    driver.SetPolicy(&driver.RulePolicy{
+        AllowedImages: []string{"busybox"},
+        MaxMemory: 64 << 20,
+        ForbiddenCapabilities: []string{"ALL"},
+    })
+    defer driver.SetPolicy(nil)
+
+    var denied *driver.PolicyDeniedError
+    _, err := driver.PullImage("alpine")
+    if !errors.As(err, &denied) || denied.Operation != driver.OperationPull || pulls != 0 {
+        test.Errorf("PullImage() returned %v after %d pulls, expected a denial before pulling", err, pulls)
+    }
+
+    _, err = driver.RunContainer(driver.DockerConfig{
+        Image: "alpine",
+        Memory: 128 << 20,
+        Security: driver.SecurityOptions{CapAdd: []string{"NET_RAW"}},
+    })
+    if !errors.As(err, &denied) || len(denied.Violations) != 3 || *creates != 0 {
+        test.Errorf("RunContainer() returned %v after %d creates, expected 3 violations before creating", err, *creates)
+    }
+
+    _, err = driver.ResizeContainer("abc", 128 << 20, 0)
+    if !errors.As(err, &denied) || denied.Operation != driver.OperationResize || updates != 0 {
+        test.Errorf("ResizeContainer() returned %v after %d updates, expected a denial before updating", err, updates)
+    }
+
+    // Admitted requests reach the daemon
+    driver.SetPolicy(nil)
+    _, err = driver.PullImage("alpine")
+    if errors.As(err, &denied) || pulls != 1 {
+        test.Errorf("PullImage() returned %v after %d pulls with no policy, expected it to pull", err, pulls)
+    }
+}
+
+func TestPolicyResizeMerged(test *testing.T) {
+    daemon := newFakeDaemon(test)
+    defer daemon.close()
+    serveValidate(daemon)
+    var current string
+    daemon.handle("/containers/abc/json", func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(`{"Id": "abc", "HostConfig": ` + current + `}`))
+    })
+    updates := 0
+    daemon.handle("/update", func(w http.ResponseWriter, r *http.Request) {
+        updates++
+        w.Write([]byte(`{}`))
+    })
+
+    driver.SetPolicy(&driver.RulePolicy{MaxCpu: 1.5})
+    defer driver.SetPolicy(nil)
+
+    // The update alone looks like less CPU than the container ends up with
+    cases := []struct {
+        name string
+        current string
+        res driver.Resources
+    }{
+        {"shorter-period", `{"CpuPeriod": 100000, "CpuQuota": 100000}`, driver.Resources{CPUPeriod: 10000}},
+        {"quota-with-period", `{"CpuPeriod": 50000, "CpuQuota": 50000}`, driver.Resources{CPUQuota: 100000}},
+    }
+    for _, c := range cases {
+        current = c.current
+        var denied *driver.PolicyDeniedError
+        _, err := driver.ResizeContainerWithResources("abc", 0, 0, c.res)
+        if !errors.As(err, &denied) || denied.Violations[0].Rule != "maxCpu" || updates != 0 {
+            test.Errorf("%s: ResizeContainerWithResources() returned %v after %d updates, expected a maxCpu denial", c.name, err, updates)
+        }
+    }
+
+    // Within the limit once merged
+    current = `{"CpuPeriod": 100000, "CpuQuota": 100000}`
+    _, err := driver.ResizeContainerWithResources("abc", 0, 0, driver.Resources{CPUPeriod: 80000})
+    if err != nil || updates != 1 {
+        test.Errorf("ResizeContainerWithResources() returned %v after %d updates, expected it to update", err, updates)
+    }
+}
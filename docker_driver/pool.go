@@ -0,0 +1,418 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver
+
+import (
+    "errors"
+    "sync"
+    "time"
+
+    "github.com/docker/docker/api/types"
+    "github.com/docker/docker/client"
+    "github.com/docker/docker/errdefs"
+    "golang.org/x/net/context"
+)
+
+// Label on warm containers, set to the ConfigHash of the template they were created from
+const LabelPool = "com.physarumsm.pool"
+
+// How often Run checks for idle templates when nothing wakes it
+const poolCheckInterval = time.Second
+
+// Options for NewContainerPool
+type PoolOptions struct {
+    Size int                // warm containers kept per template
+    Paused bool             // keep warm containers started and paused, instead of only created
+    IdleTTL time.Duration   // evict a template's warm containers once it goes unused this long, 0 never
+}
+
+// Pool of pre-created containers, so that Acquire only has to start (or unpause) one
+// Containers are pooled per DockerConfig template; call Run to fill the pool
+// Paused containers start fastest but hold their memory and host ports while warm,
+// so templates with a fixed host port need a pool of one unpaused container
+type ContainerPool struct {
+    opts PoolOptions
+    cli *client.Client
+
+    mu sync.Mutex
+    templates map[string]*poolTemplate
+    closed bool
+    err error       // last replenish failure, see Err
+
+    wake chan struct{}
+}
+
+type poolTemplate struct {
+    opt DockerConfig    // Name is cleared, containers are renamed on Acquire
+    warm []string
+    lastUsed time.Time
+}
+
+func NewContainerPool(opts PoolOptions) (*ContainerPool, error) {
+    if opts.Size <= 0 {
+        return nil, errors.New("docker_driver: Error pool size must be positive")
+    }
+
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return nil, err
+    }
+    // The client negotiates lazily on first use, which is not safe once
+    // Run and Acquire share it, so settle the version up front
+    cli.NegotiateAPIVersion(context.Background())
+
+    return &ContainerPool{
+        opts: opts,
+        cli: cli,
+        templates: make(map[string]*poolTemplate),
+        wake: make(chan struct{}, 1),
+    }, nil
+}
+
+// Key of the template a config's containers are pooled under
+func (pool *ContainerPool) poolKey(opt DockerConfig) (DockerConfig, string, error) {
+    // Only one container can hold a host port, so a second warm one
+    // (or any paused one, once the first is handed out) could never start
+    if opt.Port[1] != "" && (pool.opts.Size > 1 || pool.opts.Paused) {
+        return opt, "", errors.New("docker_driver: Error pooled containers cannot bind fixed host port " + opt.Port[1] +
+            " unless the pool is a single unpaused container")
+    }
+    opt.Name = ""
+    key, err := ConfigHash(opt)
+    return opt, key, err
+}
+
+// Register a template so that Run starts filling it before the first Acquire
+func (pool *ContainerPool) Prewarm(opt DockerConfig) error {
+    opt, key, err := pool.poolKey(opt)
+    if err != nil {
+        return err
+    }
+
+    pool.mu.Lock()
+    pool.template(key, opt)
+    pool.mu.Unlock()
+
+    pool.notify()
+    return nil
+}
+
+// Number of warm containers ready for a template
+func (pool *ContainerPool) Len(opt DockerConfig) int {
+    _, key, err := pool.poolKey(opt)
+    if err != nil {
+        return 0
+    }
+
+    pool.mu.Lock()
+    defer pool.mu.Unlock()
+    if tmpl, ok := pool.templates[key]; ok {
+        return len(tmpl.warm)
+    }
+    return 0
+}
+
+// IDs of every warm container, not yet handed out by Acquire
+// Warm containers carry the driver's ownership labels, so pass these to
+// RemoveOrphanContainers along with the containers in use
+func (pool *ContainerPool) Warm() []string {
+    pool.mu.Lock()
+    defer pool.mu.Unlock()
+
+    var warm []string
+    for _, tmpl := range pool.templates {
+        warm = append(warm, tmpl.warm...)
+    }
+    return warm
+}
+
+// Last error Run hit creating a warm container, whose template it then dropped
+// Cleared once a warm container is created again
+func (pool *ContainerPool) Err() error {
+    pool.mu.Lock()
+    defer pool.mu.Unlock()
+    return pool.err
+}
+
+// Get a running container for opt, named opt.Name if set
+// Hands out a warm container if one is ready, otherwise creates one directly
+// Either way the template is (re)registered, so Run keeps it filled
+// Warm containers are checked against the current policy first, see SetPolicy
+func (pool *ContainerPool) Acquire(opt DockerConfig) (string, error) {
+    ctx := context.Background()
+
+    tmplOpt, key, err := pool.poolKey(opt)
+    if err != nil {
+        return "", err
+    }
+    verr := &ValidationError{}
+    validateName(verr, opt.Name)
+    if len(verr.Violations) > 0 {
+        return "", verr
+    }
+
+    for {
+        pool.mu.Lock()
+        if pool.closed {
+            pool.mu.Unlock()
+            return "", errors.New("docker_driver: Error pool is closed")
+        }
+        tmpl := pool.template(key, tmplOpt)
+        tmpl.lastUsed = time.Now()
+        var cont string
+        if len(tmpl.warm) > 0 {
+            cont = tmpl.warm[0]
+            tmpl.warm = tmpl.warm[1:]
+        }
+        pool.mu.Unlock()
+
+        pool.notify()
+        if cont == "" {
+            break
+        }
+
+        // The policy may have been set or tightened since the container was warmed
+        if err := pool.admitWarm(tmplOpt); err != nil {
+            pool.cli.ContainerRemove(ctx, cont, types.ContainerRemoveOptions{Force: true})
+            pool.discard(ctx, key)
+            return "", err
+        }
+
+        var err error
+        if opt.Name != "" {
+            err = pool.cli.ContainerRename(ctx, cont, opt.Name)
+            // A taken or refused name is the caller's problem, not the container's
+            if errdefs.IsConflict(err) || errdefs.IsInvalidParameter(err) {
+                pool.putBack(ctx, key, cont)
+                return "", err
+            }
+        }
+        if err == nil {
+            err = pool.activate(ctx, cont)
+        }
+        if err == nil {
+            return cont, nil
+        }
+        // Removed or broken behind our back, try the next one
+        pool.cli.ContainerRemove(ctx, cont, types.ContainerRemoveOptions{Force: true})
+    }
+
+    contID, _, err := runContainer(ctx, pool.cli, opt)
+    return contID, err
+}
+
+// Check a template's warm containers against the current policy
+func (pool *ContainerPool) admitWarm(opt DockerConfig) error {
+    _, hostConfig, err := containerConfigs(opt, nil)
+    if err != nil {
+        return err
+    }
+    return admitCreate(opt, hostConfig)
+}
+
+// Drop a template and remove its warm containers
+func (pool *ContainerPool) discard(ctx context.Context, key string) {
+    pool.mu.Lock()
+    var warm []string
+    if tmpl, ok := pool.templates[key]; ok {
+        warm = tmpl.warm
+        delete(pool.templates, key)
+    }
+    pool.mu.Unlock()
+
+    for _, cont := range warm {
+        pool.cli.ContainerRemove(ctx, cont, types.ContainerRemoveOptions{Force: true})
+    }
+}
+
+// Return a warm container Acquire took but could not hand out
+func (pool *ContainerPool) putBack(ctx context.Context, key, cont string) {
+    pool.mu.Lock()
+    tmpl, exists := pool.templates[key]
+    if exists && !pool.closed {
+        tmpl.warm = append([]string{cont}, tmpl.warm...)
+        cont = ""
+    }
+    pool.mu.Unlock()
+
+    // Template was evicted or the pool closed in the meantime
+    if cont != "" {
+        pool.cli.ContainerRemove(ctx, cont, types.ContainerRemoveOptions{Force: true})
+    }
+}
+
+// Turn a warm container into a running one
+func (pool *ContainerPool) activate(ctx context.Context, cont string) error {
+    if pool.opts.Paused {
+        return pool.cli.ContainerUnpause(ctx, cont)
+    }
+    return pool.cli.ContainerStart(ctx, cont, types.ContainerStartOptions{})
+}
+
+// Must be called with pool.mu held
+func (pool *ContainerPool) template(key string, opt DockerConfig) *poolTemplate {
+    tmpl, ok := pool.templates[key]
+    if !ok {
+        tmpl = &poolTemplate{opt: opt, lastUsed: time.Now()}
+        pool.templates[key] = tmpl
+    }
+    return tmpl
+}
+
+func (pool *ContainerPool) notify() {
+    select {
+    case pool.wake <- struct{}{}:
+    default:
+    }
+}
+
+// Keep every template filled and evict idle ones until ctx is cancelled
+// A template whose containers fail to create is dropped from the pool along with
+// its warm containers, so the next Acquire for it creates directly and returns
+// the error to its caller; the error is also kept for Err
+func (pool *ContainerPool) Run(ctx context.Context) error {
+    ticker := time.NewTicker(poolCheckInterval)
+    defer ticker.Stop()
+
+    for {
+        pool.evictIdle(ctx)
+        pool.replenish(ctx)
+
+        select {
+        case <-pool.wake:
+        case <-ticker.C:
+        case <-ctx.Done():
+            return nil
+        }
+    }
+}
+
+func (pool *ContainerPool) evictIdle(ctx context.Context) {
+    if pool.opts.IdleTTL <= 0 {
+        return
+    }
+
+    var evicted []string
+    pool.mu.Lock()
+    for key, tmpl := range pool.templates {
+        if time.Since(tmpl.lastUsed) > pool.opts.IdleTTL {
+            evicted = append(evicted, tmpl.warm...)
+            delete(pool.templates, key)
+        }
+    }
+    pool.mu.Unlock()
+
+    for _, cont := range evicted {
+        pool.cli.ContainerRemove(ctx, cont, types.ContainerRemoveOptions{Force: true})
+    }
+}
+
+// Create containers until every template has Size warm ones
+func (pool *ContainerPool) replenish(ctx context.Context) {
+    for ctx.Err() == nil {
+        key, opt, ok := pool.nextShort()
+        if !ok {
+            return
+        }
+
+        cont, err := pool.createWarm(ctx, key, opt)
+        if err != nil {
+            pool.mu.Lock()
+            pool.err = err
+            pool.mu.Unlock()
+            pool.discard(ctx, key)
+            continue
+        }
+
+        pool.mu.Lock()
+        pool.err = nil
+        tmpl, exists := pool.templates[key]
+        if exists && !pool.closed {
+            tmpl.warm = append(tmpl.warm, cont)
+            cont = ""
+        }
+        pool.mu.Unlock()
+
+        // Template was evicted or the pool closed while creating
+        if cont != "" {
+            pool.cli.ContainerRemove(ctx, cont, types.ContainerRemoveOptions{Force: true})
+        }
+    }
+}
+
+// Find a template that is short of warm containers
+func (pool *ContainerPool) nextShort() (string, DockerConfig, bool) {
+    pool.mu.Lock()
+    defer pool.mu.Unlock()
+
+    if pool.closed {
+        return "", DockerConfig{}, false
+    }
+    for key, tmpl := range pool.templates {
+        if len(tmpl.warm) < pool.opts.Size {
+            return key, tmpl.opt, true
+        }
+    }
+    return "", DockerConfig{}, false
+}
+
+func (pool *ContainerPool) createWarm(ctx context.Context, key string, opt DockerConfig) (string, error) {
+    // Kept out of the config hash, so warm containers match a RunContainer of the same config
+    resp, err := createContainer(ctx, pool.cli, opt, map[string]string{LabelPool: key})
+    if err != nil {
+        return "", err
+    }
+    if !pool.opts.Paused {
+        return resp.ID, nil
+    }
+
+    err = pool.cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{})
+    if err == nil {
+        err = pool.cli.ContainerPause(ctx, resp.ID)
+    }
+    if err != nil {
+        pool.cli.ContainerRemove(ctx, resp.ID, types.ContainerRemoveOptions{Force: true})
+        return "", err
+    }
+    return resp.ID, nil
+}
+
+// Remove all warm containers and release the pool
+// Containers already handed out by Acquire are left alone
+func (pool *ContainerPool) Close() error {
+    ctx := context.Background()
+
+    pool.mu.Lock()
+    pool.closed = true
+    var warm []string
+    for _, tmpl := range pool.templates {
+        warm = append(warm, tmpl.warm...)
+    }
+    pool.templates = make(map[string]*poolTemplate)
+    pool.mu.Unlock()
+
+    var firstErr error
+    for _, cont := range warm {
+        err := pool.cli.ContainerRemove(ctx, cont, types.ContainerRemoveOptions{Force: true})
+        if err != nil && firstErr == nil {
+            firstErr = err
+        }
+    }
+
+    if err := pool.cli.Close(); err != nil && firstErr == nil {
+        firstErr = err
+    }
+    return firstErr
+}
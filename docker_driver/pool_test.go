@@ -0,0 +1,337 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver_test
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    driver "github.com/PhysarumSM/docker-driver/docker_driver"
+)
+
+// Records what the pool asked the fake daemon to do
+type poolCalls struct {
+    mu sync.Mutex
+    created int
+    labels map[string]string    // of the last container created
+    calls map[string]int
+}
+
+func (calls *poolCalls) count(call string) int {
+    calls.mu.Lock()
+    defer calls.mu.Unlock()
+    return calls.calls[call]
+}
+
+func servePool(daemon *fakeDaemon) *poolCalls {
+    calls := &poolCalls{calls: make(map[string]int)}
+    record := func(call string) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+            calls.mu.Lock()
+            calls.calls[call]++
+            calls.mu.Unlock()
+            w.WriteHeader(http.StatusNoContent)
+        }
+    }
+
+    daemon.handle("/containers/create", func(w http.ResponseWriter, r *http.Request) {
+        var body struct {
+            Labels map[string]string
+        }
+        json.NewDecoder(r.Body).Decode(&body)
+        calls.mu.Lock()
+        calls.labels = body.Labels
+        calls.created++
+        id := calls.created
+        calls.mu.Unlock()
+        w.WriteHeader(http.StatusCreated)
+        // Warm container IDs share a suffix so that removals can be routed
+        fmt.Fprintf(w, `{"Id": "%d-warm", "Warnings": []}`, id)
+    })
+    daemon.handle("/start", record("start"))
+    daemon.handle("/pause", record("pause"))
+    daemon.handle("/unpause", record("unpause"))
+    daemon.handle("/rename", record("rename"))
+    daemon.handle("-warm", record("remove"))
+    return calls
+}
+
+func waitWarm(test *testing.T, pool *driver.ContainerPool, opt driver.DockerConfig, n int) {
+    deadline := time.Now().Add(5 * time.Second)
+    for pool.Len(opt) != n {
+        if time.Now().After(deadline) {
+            test.Fatalf("Pool has %d warm containers, expected %d", pool.Len(opt), n)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+func TestContainerPoolAcquire(test *testing.T) {
+    daemon := newFakeDaemon(test)
+    defer daemon.close()
+    calls := servePool(daemon)
+
+    pool, err := driver.NewContainerPool(driver.PoolOptions{Size: 2, Paused: true})
+    if err != nil {
+        test.Fatalf("NewContainerPool() returned:\n%v", err)
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go pool.Run(ctx)
+
+    opt := driver.DockerConfig{Image: "busybox", Cmd: []string{"sleep", "300"}}
+    pool.Prewarm(opt)
+    waitWarm(test, pool, opt, 2)
+    if calls.count("start") != 2 || calls.count("pause") != 2 {
+        test.Errorf("Warm containers started %d and paused %d times, expected 2 each",
+            calls.count("start"), calls.count("pause"))
+    }
+
+    // Same hash as a RunContainer of the config, whatever its name
+    named := opt
+    named.Name = "web"
+    hash, err := driver.ConfigHash(named)
+    calls.mu.Lock()
+    labels := calls.labels
+    calls.mu.Unlock()
+    if err != nil || labels[driver.LabelConfigHash] != hash || labels[driver.LabelPool] != hash {
+        test.Errorf("Warm container labelled %v, expected config and pool hashes of %s", labels, hash)
+    }
+
+    if warm := pool.Warm(); len(warm) != 2 || !strings.HasSuffix(warm[0], "-warm") {
+        test.Errorf("Warm() returned %v, expected the 2 warm containers", warm)
+    }
+
+    // Name does not change the template, it is applied on Acquire
+    opt.Name = "web"
+    contID, err := pool.Acquire(opt)
+    if err != nil {
+        test.Fatalf("Acquire() returned:\n%v", err)
+    }
+    if !strings.HasSuffix(contID, "-warm") {
+        test.Errorf("Acquire() returned %s, expected a warm container", contID)
+    }
+    if calls.count("rename") != 1 || calls.count("unpause") != 1 {
+        test.Errorf("Acquire() renamed %d and unpaused %d times, expected 1 each",
+            calls.count("rename"), calls.count("unpause"))
+    }
+
+    // Replaced in the background
+    waitWarm(test, pool, opt, 2)
+
+    err = pool.Close()
+    if err != nil {
+        test.Errorf("Close() returned:\n%v", err)
+    }
+    if calls.count("remove") != 2 {
+        test.Errorf("Close() removed %d containers, expected the 2 warm ones", calls.count("remove"))
+    }
+    if _, err := pool.Acquire(opt); err == nil {
+        test.Errorf("Acquire() succeeded on a closed pool, expected it to fail")
+    }
+}
+
+func TestContainerPoolIdleTTL(test *testing.T) {
+    daemon := newFakeDaemon(test)
+    defer daemon.close()
+    calls := servePool(daemon)
+
+    pool, err := driver.NewContainerPool(driver.PoolOptions{Size: 1, IdleTTL: 100 * time.Millisecond})
+    if err != nil {
+        test.Fatalf("NewContainerPool() returned:\n%v", err)
+    }
+    defer pool.Close()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go pool.Run(ctx)
+
+    opt := driver.DockerConfig{Image: "busybox"}
+    pool.Prewarm(opt)
+    waitWarm(test, pool, opt, 1)
+    if calls.count("start") != 0 {
+        test.Errorf("Created warm container was started, expected it to wait for Acquire")
+    }
+
+    // Dropped from the pool first, then removed from the daemon
+    waitWarm(test, pool, opt, 0)
+    deadline := time.Now().Add(5 * time.Second)
+    for calls.count("remove") != 1 && time.Now().Before(deadline) {
+        time.Sleep(10 * time.Millisecond)
+    }
+    if calls.count("remove") != 1 {
+        test.Errorf("Eviction removed %d containers, expected 1", calls.count("remove"))
+    }
+}
+
+func TestContainerPoolCreateError(test *testing.T) {
+    daemon := newFakeDaemon(test)
+    defer daemon.close()
+
+    daemon.handle("/containers/create", func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusNotFound)
+        w.Write([]byte(`{"message": "No such image: missing"}`))
+    })
+
+    pool, err := driver.NewContainerPool(driver.PoolOptions{Size: 1})
+    if err != nil {
+        test.Fatalf("NewContainerPool() returned:\n%v", err)
+    }
+    defer pool.Close()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go pool.Run(ctx)
+
+    // Falls through to a direct create, which reports the daemon's error
+    _, err = pool.Acquire(driver.DockerConfig{Image: "missing"})
+    if err == nil || !strings.Contains(err.Error(), "No such image") {
+        test.Errorf("Acquire() returned %v, expected the create error", err)
+    }
+
+    // A failed Prewarm is reported too
+    pool.Prewarm(driver.DockerConfig{Image: "missing", Cmd: []string{"true"}})
+    deadline := time.Now().Add(5 * time.Second)
+    for pool.Err() == nil && time.Now().Before(deadline) {
+        time.Sleep(10 * time.Millisecond)
+    }
+    if err := pool.Err(); err == nil || !strings.Contains(err.Error(), "No such image") {
+        test.Errorf("Err() returned %v, expected the create error", err)
+    }
+}
+
+func TestContainerPoolHostPort(test *testing.T) {
+    daemon := newFakeDaemon(test)
+    defer daemon.close()
+    calls := servePool(daemon)
+
+    opt := driver.DockerConfig{Image: "busybox", Port: [2]string{"80/tcp", "8080"}}
+    for _, opts := range []driver.PoolOptions{{Size: 2}, {Size: 1, Paused: true}} {
+        pool, err := driver.NewContainerPool(opts)
+        if err != nil {
+            test.Fatalf("NewContainerPool() returned:\n%v", err)
+        }
+        if err := pool.Prewarm(opt); err == nil {
+            test.Errorf("Prewarm() accepted a fixed host port with %+v, expected it to fail", opts)
+        }
+        if _, err := pool.Acquire(opt); err == nil || !strings.Contains(err.Error(), "host port") {
+            test.Errorf("Acquire() returned %v with %+v, expected the host port error", err, opts)
+        }
+        pool.Close()
+    }
+    if calls.created != 0 {
+        test.Errorf("Pool created %d containers for a rejected template", calls.created)
+    }
+
+    // One created container only binds the port once acquired
+    pool, err := driver.NewContainerPool(driver.PoolOptions{Size: 1})
+    if err != nil {
+        test.Fatalf("NewContainerPool() returned:\n%v", err)
+    }
+    defer pool.Close()
+    if err := pool.Prewarm(opt); err != nil {
+        test.Errorf("Prewarm() returned %v for a single unpaused container", err)
+    }
+}
+
+func TestContainerPoolPolicy(test *testing.T) {
+    daemon := newFakeDaemon(test)
+    defer daemon.close()
+    calls := servePool(daemon)
+
+    pool, err := driver.NewContainerPool(driver.PoolOptions{Size: 2})
+    if err != nil {
+        test.Fatalf("NewContainerPool() returned:\n%v", err)
+    }
+    defer pool.Close()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go pool.Run(ctx)
+
+    opt := driver.DockerConfig{Image: "busybox", Cmd: []string{"sleep", "300"}}
+    pool.Prewarm(opt)
+    waitWarm(test, pool, opt, 2)
+
+    // Tightened after the containers were warmed
+    driver.SetPolicy(&driver.RulePolicy{MaxMemory: 64 << 20})
+    defer driver.SetPolicy(nil)
+
+    _, err = pool.Acquire(opt)
+    var denied *driver.PolicyDeniedError
+    if !errors.As(err, &denied) {
+        test.Fatalf("Acquire() returned %v, expected a *PolicyDeniedError", err)
+    }
+    if calls.count("start") != 0 {
+        test.Errorf("Acquire() started a container the policy denies")
+    }
+
+    deadline := time.Now().Add(5 * time.Second)
+    for calls.count("remove") != 2 && time.Now().Before(deadline) {
+        time.Sleep(10 * time.Millisecond)
+    }
+    if calls.count("remove") != 2 || pool.Len(opt) != 0 {
+        test.Errorf("Pool removed %d and kept %d warm containers, expected both removed", calls.count("remove"), pool.Len(opt))
+    }
+}
+
+func TestContainerPoolNameTaken(test *testing.T) {
+    daemon := newFakeDaemon(test)
+    defer daemon.close()
+    calls := servePool(daemon)
+    daemon.handle("/rename", func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusConflict)
+        w.Write([]byte(`{"message": "Conflict. The container name \"/web\" is already in use"}`))
+    })
+
+    pool, err := driver.NewContainerPool(driver.PoolOptions{Size: 2})
+    if err != nil {
+        test.Fatalf("NewContainerPool() returned:\n%v", err)
+    }
+    defer pool.Close()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go pool.Run(ctx)
+
+    opt := driver.DockerConfig{Image: "busybox", Cmd: []string{"sleep", "300"}}
+    pool.Prewarm(opt)
+    waitWarm(test, pool, opt, 2)
+
+    // The caller's mistake must not cost the pool its warm containers
+    opt.Name = "web"
+    if _, err := pool.Acquire(opt); err == nil || !strings.Contains(err.Error(), "already in use") {
+        test.Errorf("Acquire() returned %v, expected the rename conflict", err)
+    }
+    if calls.count("remove") != 0 || calls.count("start") != 0 || pool.Len(opt) != 2 {
+        test.Errorf("Acquire() removed %d and started %d containers, leaving %d warm, expected both kept warm",
+            calls.count("remove"), calls.count("start"), pool.Len(opt))
+    }
+
+    // Caught before any warm container is taken
+    opt.Name = "-web"
+    var verr *driver.ValidationError
+    if _, err := pool.Acquire(opt); !errors.As(err, &verr) || verr.Violations[0].Field != "Name" {
+        test.Errorf("Acquire() returned %v, expected a Name violation", err)
+    }
+}
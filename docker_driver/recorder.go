@@ -0,0 +1,252 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver
+
+import (
+    "errors"
+    "math"
+    "sort"
+    "sync"
+    "time"
+
+    "golang.org/x/net/context"
+)
+
+// Summary of one metric over a window of samples
+type SeriesSummary struct {
+    Mean float64
+    Max float64
+    P50 float64
+    P95 float64
+    P99 float64
+    EWMA float64    // weighted towards the most recent samples
+}
+
+// Summary of a container's recorded samples over a window
+// Network values are rates in bytes per second
+type StatsSummary struct {
+    Samples int
+    From time.Time
+    To time.Time
+    CPU SeriesSummary           // percent
+    Memory SeriesSummary        // percent of limit
+    NetworkRx SeriesSummary
+    NetworkTx SeriesSummary
+}
+
+// One recorded point in a container's time series
+type statsPoint struct {
+    time time.Time
+    cpu float64
+    memory float64
+    networkRx float64
+    networkTx float64
+    hasRate bool            // false for the first sample and after a counter reset
+}
+
+// Fixed-size ring of points, oldest overwritten first
+type statsRing struct {
+    points []statsPoint
+    head int                // index of the oldest point
+    count int
+
+    // Cumulative counters of the last sample, to turn them into rates
+    lastTime time.Time
+    lastRx uint64
+    lastTx uint64
+}
+
+func (ring *statsRing) add(point statsPoint) {
+    if ring.count < len(ring.points) {
+        ring.points[(ring.head + ring.count) % len(ring.points)] = point
+        ring.count++
+        return
+    }
+    ring.points[ring.head] = point
+    ring.head = (ring.head + 1) % len(ring.points)
+}
+
+// Points no older than since, oldest first
+func (ring *statsRing) since(since time.Time) []statsPoint {
+    var points []statsPoint
+    for i := 0; i < ring.count; i++ {
+        point := ring.points[(ring.head + i) % len(ring.points)]
+        if !point.time.Before(since) {
+            points = append(points, point)
+        }
+    }
+    return points
+}
+
+// Keeps a bounded window of samples per container
+// Safe for concurrent use
+type StatsRecorder struct {
+    mu sync.Mutex
+    capacity int
+    alpha float64
+    series map[string]*statsRing
+}
+
+// Create a recorder keeping up to capacity samples per container
+// alpha is the EWMA smoothing factor in (0, 1], higher favours recent samples
+func NewStatsRecorder(capacity int, alpha float64) (*StatsRecorder, error) {
+    if capacity <= 0 {
+        return nil, errors.New("docker_driver: Error recorder capacity must be positive")
+    }
+    if alpha <= 0 || alpha > 1 {
+        return nil, errors.New("docker_driver: Error EWMA alpha must be in (0, 1]")
+    }
+
+    return &StatsRecorder{
+        capacity: capacity,
+        alpha: alpha,
+        series: make(map[string]*statsRing),
+    }, nil
+}
+
+// Add a sample for a container
+// Samples must be recorded in time order
+func (recorder *StatsRecorder) Record(cont string, metrics ContainerMetrics) {
+    var rx, tx uint64
+    for _, network := range metrics.Networks {
+        rx += network.RxBytes
+        tx += network.TxBytes
+    }
+
+    recorder.mu.Lock()
+    defer recorder.mu.Unlock()
+
+    ring, ok := recorder.series[cont]
+    if !ok {
+        ring = &statsRing{points: make([]statsPoint, recorder.capacity)}
+        recorder.series[cont] = ring
+    }
+
+    point := statsPoint{time: metrics.Time, cpu: metrics.CPUPercent, memory: metrics.MemoryPercent}
+
+    // Counters reset when a container restarts, skip the rate for that sample
+    elapsed := metrics.Time.Sub(ring.lastTime).Seconds()
+    if !ring.lastTime.IsZero() && elapsed > 0 && rx >= ring.lastRx && tx >= ring.lastTx {
+        point.networkRx = float64(rx - ring.lastRx) / elapsed
+        point.networkTx = float64(tx - ring.lastTx) / elapsed
+        point.hasRate = true
+    }
+    ring.lastTime = metrics.Time
+    ring.lastRx = rx
+    ring.lastTx = tx
+
+    ring.add(point)
+}
+
+// Summarize a container's samples from the last window, measured back
+// from its most recent sample
+// window of 0 summarizes every retained sample
+func (recorder *StatsRecorder) Summary(cont string, window time.Duration) (StatsSummary, error) {
+    recorder.mu.Lock()
+    ring, ok := recorder.series[cont]
+    var points []statsPoint
+    if ok {
+        since := time.Time{}
+        if window > 0 {
+            since = ring.lastTime.Add(-window)
+        }
+        points = ring.since(since)
+    }
+    recorder.mu.Unlock()
+
+    if len(points) == 0 {
+        return StatsSummary{}, errors.New("docker_driver: Error no samples recorded for container " + cont)
+    }
+
+    series := func(value func(statsPoint) float64) []float64 {
+        values := make([]float64, len(points))
+        for i, point := range points {
+            values[i] = value(point)
+        }
+        return values
+    }
+    // Only samples with a rate, the network summaries are zero until there are any
+    rates := func(value func(statsPoint) float64) SeriesSummary {
+        var values []float64
+        for _, point := range points {
+            if point.hasRate {
+                values = append(values, value(point))
+            }
+        }
+        if len(values) == 0 {
+            return SeriesSummary{}
+        }
+        return summarize(values, recorder.alpha)
+    }
+
+    return StatsSummary{
+        Samples: len(points),
+        From: points[0].time,
+        To: points[len(points) - 1].time,
+        CPU: summarize(series(func(p statsPoint) float64 { return p.cpu }), recorder.alpha),
+        Memory: summarize(series(func(p statsPoint) float64 { return p.memory }), recorder.alpha),
+        NetworkRx: rates(func(p statsPoint) float64 { return p.networkRx }),
+        NetworkTx: rates(func(p statsPoint) float64 { return p.networkTx }),
+    }, nil
+}
+
+// Drop a container's samples, e.g. once it has been deleted
+func (recorder *StatsRecorder) Forget(cont string) {
+    recorder.mu.Lock()
+    defer recorder.mu.Unlock()
+    delete(recorder.series, cont)
+}
+
+// Record samples from StreamContainerStats until ctx is cancelled
+// Returns nil on cancellation, otherwise the error that ended the stream
+func (recorder *StatsRecorder) Watch(ctx context.Context, cont string) error {
+    samples, errs := StreamContainerStats(ctx, cont)
+    for sample := range samples {
+        recorder.Record(cont, sample.ContainerMetrics)
+    }
+    return <-errs
+}
+
+// values are in time order, oldest first
+func summarize(values []float64, alpha float64) SeriesSummary {
+    summary := SeriesSummary{Max: math.Inf(-1), EWMA: values[0]}
+
+    sum := 0.0
+    for i, value := range values {
+        sum += value
+        summary.Max = math.Max(summary.Max, value)
+        if i > 0 {
+            summary.EWMA = alpha * value + (1 - alpha) * summary.EWMA
+        }
+    }
+    summary.Mean = sum / float64(len(values))
+
+    sorted := append([]float64(nil), values...)
+    sort.Float64s(sorted)
+    summary.P50 = percentile(sorted, 50)
+    summary.P95 = percentile(sorted, 95)
+    summary.P99 = percentile(sorted, 99)
+
+    return summary
+}
+
+// Nearest-rank percentile of sorted values
+func percentile(sorted []float64, p float64) float64 {
+    rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+    if rank < 1 {
+        rank = 1
+    }
+    return sorted[rank - 1]
+}
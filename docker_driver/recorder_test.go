@@ -0,0 +1,136 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver_test
+
+import (
+    "math"
+    "testing"
+    "time"
+
+    driver "github.com/PhysarumSM/docker-driver/docker_driver"
+)
+
+func TestStatsRecorder(test *testing.T) {
+    recorder, err := driver.NewStatsRecorder(100, 0.5)
+    if err != nil {
+        test.Fatalf("NewStatsRecorder() returned:\n%v", err)
+    }
+
+    // CPU 1..150 at one second intervals, network rx grows 1000 bytes/s
+    start := time.Date(2020, 8, 20, 0, 0, 0, 0, time.UTC)
+    for i := 1; i <= 150; i++ {
+        recorder.Record("cont", driver.ContainerMetrics{
+            Time: start.Add(time.Duration(i) * time.Second),
+            CPUPercent: float64(i),
+            MemoryPercent: 50,
+            Networks: map[string]driver.NetworkMetrics{
+                "eth0": {RxBytes: uint64(i) * 1000},
+            },
+        })
+    }
+
+    test.Run("Summary-all", func(test *testing.T) {
+        // Only the last 100 samples (CPU 51..150) are retained
+        all, err := recorder.Summary("cont", 0)
+        if err != nil {
+            test.Fatalf("Summary() returned:\n%v", err)
+        }
+        if all.Samples != 100 {
+            test.Errorf("Summary() returned %d samples, expected 100", all.Samples)
+        }
+        if all.CPU.Mean != 100.5 || all.CPU.Max != 150 {
+            test.Errorf("Summary() returned CPU mean %v max %v, expected 100.5 and 150", all.CPU.Mean, all.CPU.Max)
+        }
+        if all.CPU.P50 != 100 || all.CPU.P95 != 145 || all.CPU.P99 != 149 {
+            test.Errorf("Summary() returned CPU percentiles %v/%v/%v, expected 100/145/149", all.CPU.P50, all.CPU.P95, all.CPU.P99)
+        }
+        if all.Memory.Mean != 50 || all.Memory.EWMA != 50 {
+            test.Errorf("Summary() returned memory mean %v EWMA %v, expected 50", all.Memory.Mean, all.Memory.EWMA)
+        }
+        if all.NetworkRx.P50 != 1000 || all.NetworkRx.Mean != 1000 {
+            test.Errorf("Summary() returned network rx rate P50 %v mean %v, expected 1000", all.NetworkRx.P50, all.NetworkRx.Mean)
+        }
+    })
+
+    test.Run("Summary-window", func(test *testing.T) {
+        // Last 10 seconds covers CPU 140..150
+        window, err := recorder.Summary("cont", 10 * time.Second)
+        if err != nil {
+            test.Fatalf("Summary() returned:\n%v", err)
+        }
+        if window.Samples != 11 || window.CPU.Mean != 145 {
+            test.Errorf("Summary() returned %d samples with CPU mean %v, expected 11 and 145", window.Samples, window.CPU.Mean)
+        }
+
+        // With alpha 0.5 the EWMA of a linear ramp lags the latest value by about one step
+        if math.Abs(window.CPU.EWMA - 149) > 0.01 {
+            test.Errorf("Summary() returned CPU EWMA %v, expected about 149", window.CPU.EWMA)
+        }
+    })
+
+    test.Run("Summary-network", func(test *testing.T) {
+        // First sample and the one after a counter reset have no rate
+        rates, err := driver.NewStatsRecorder(10, 0.5)
+        if err != nil {
+            test.Fatalf("NewStatsRecorder() returned:\n%v", err)
+        }
+        for i, rx := range []uint64{5000, 6000, 7000, 500, 1500, 2500} {
+            rates.Record("cont", driver.ContainerMetrics{
+                Time: start.Add(time.Duration(i) * time.Second),
+                Networks: map[string]driver.NetworkMetrics{"eth0": {RxBytes: rx}},
+            })
+        }
+
+        summary, err := rates.Summary("cont", 0)
+        if err != nil {
+            test.Fatalf("Summary() returned:\n%v", err)
+        }
+        if summary.Samples != 6 {
+            test.Errorf("Summary() returned %d samples, expected 6", summary.Samples)
+        }
+        if summary.NetworkRx.Mean != 1000 || summary.NetworkRx.P50 != 1000 || summary.NetworkRx.EWMA != 1000 {
+            test.Errorf("Summary() returned network rx mean %v P50 %v EWMA %v, expected 1000",
+                summary.NetworkRx.Mean, summary.NetworkRx.P50, summary.NetworkRx.EWMA)
+        }
+
+        // No rate yet from a single sample
+        rates.Forget("cont")
+        rates.Record("cont", driver.ContainerMetrics{Time: start, Networks: map[string]driver.NetworkMetrics{"eth0": {RxBytes: 5000}}})
+        summary, err = rates.Summary("cont", 0)
+        if err != nil || summary.NetworkRx != (driver.SeriesSummary{}) {
+            test.Errorf("Summary() returned network rx %+v, %v for a single sample, expected zero", summary.NetworkRx, err)
+        }
+    })
+
+    test.Run("Summary-fail", func(test *testing.T) {
+        recorder.Forget("cont")
+        _, err := recorder.Summary("cont", 0)
+        if err == nil {
+            test.Errorf("Summary() succeeded for forgotten container, expected it to fail")
+        }
+    })
+}
+
+func TestNewStatsRecorder(test *testing.T) {
+    _, err := driver.NewStatsRecorder(0, 0.5)
+    if err == nil {
+        test.Errorf("NewStatsRecorder() succeeded with zero capacity, expected it to fail")
+    }
+
+    _, err = driver.NewStatsRecorder(10, 1.5)
+    if err == nil {
+        test.Errorf("NewStatsRecorder() succeeded with alpha above 1, expected it to fail")
+    }
+}
@@ -0,0 +1,153 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver
+
+import (
+    "errors"
+    "math"
+
+    "github.com/docker/docker/api/types/blkiodev"
+    "github.com/docker/docker/api/types/container"
+    "github.com/docker/docker/client"
+    "github.com/docker/go-units"
+    "golang.org/x/net/context"
+)
+
+// Resource controls beyond DockerConfig's Memory and Cpu
+// Zero values leave the daemon's defaults at creation, and the current value on resize
+// CPUPeriod and CPUQuota cannot be combined with Cpu, which the daemon turns into its own quota
+type Resources struct {
+    MemoryReservation int64     // soft limit in bytes, enforced when the host runs short
+    MemorySwap int64            // memory plus swap in bytes, -1 is unlimited swap
+    CPUShares int64             // relative weight against other containers, daemon default 1024
+    CpusetCpus string           // CPUs allowed to run on, e.g. "0-2,4"
+    CpusetMems string           // NUMA memory nodes allowed, e.g. "0,1"
+    CPUPeriod int64             // CFS period in microseconds
+    CPUQuota int64              // CFS quota in microseconds per period
+    PidsLimit int64             // max processes, -1 is unlimited
+    BlkioWeight uint16          // relative block IO weight, 10 to 1000
+
+    // Only settable at creation
+    DeviceReadBps []ThrottleDevice
+    DeviceWriteBps []ThrottleDevice
+    DeviceReadIOps []ThrottleDevice
+    DeviceWriteIOps []ThrottleDevice
+    OomScoreAdj int             // -1000 to 1000, higher is killed first when the host is out of memory
+    Ulimits []Ulimit
+}
+
+// Rate limit for a block device, in bytes or operations per second
+type ThrottleDevice struct {
+    Path string     // e.g. /dev/sda
+    Rate uint64
+}
+
+// Process limit inside the container, e.g. Name "nofile"
+type Ulimit struct {
+    Name string
+    Soft int64
+    Hard int64
+}
+
+func throttleDevices(devices []ThrottleDevice) []*blkiodev.ThrottleDevice {
+    var converted []*blkiodev.ThrottleDevice
+    for _, device := range devices {
+        converted = append(converted, &blkiodev.ThrottleDevice{Path: device.Path, Rate: device.Rate})
+    }
+    return converted
+}
+
+// Combine with DockerConfig's Memory and Cpu into the daemon's resources
+func (res Resources) toDocker(memory int64, cpu float64) container.Resources {
+    resources := container.Resources{
+        Memory: memory,
+        NanoCPUs: int64(cpu*(math.Pow(10, 9))),
+        MemoryReservation: res.MemoryReservation,
+        MemorySwap: res.MemorySwap,
+        CPUShares: res.CPUShares,
+        CpusetCpus: res.CpusetCpus,
+        CpusetMems: res.CpusetMems,
+        CPUPeriod: res.CPUPeriod,
+        CPUQuota: res.CPUQuota,
+        BlkioWeight: res.BlkioWeight,
+        BlkioDeviceReadBps: throttleDevices(res.DeviceReadBps),
+        BlkioDeviceWriteBps: throttleDevices(res.DeviceWriteBps),
+        BlkioDeviceReadIOps: throttleDevices(res.DeviceReadIOps),
+        BlkioDeviceWriteIOps: throttleDevices(res.DeviceWriteIOps),
+    }
+    // nil leaves the limit alone on update, so only send one if asked
+    if res.PidsLimit != 0 {
+        pidsLimit := res.PidsLimit
+        resources.PidsLimit = &pidsLimit
+    }
+    for _, ulimit := range res.Ulimits {
+        resources.Ulimits = append(resources.Ulimits, &units.Ulimit{Name: ulimit.Name, Soft: ulimit.Soft, Hard: ulimit.Hard})
+    }
+    return resources
+}
+
+// The daemon silently ignores these on update, so refuse rather than pretend
+func (res Resources) checkUpdatable() error {
+    if len(res.DeviceReadBps) > 0 || len(res.DeviceWriteBps) > 0 ||
+        len(res.DeviceReadIOps) > 0 || len(res.DeviceWriteIOps) > 0 {
+        return errors.New("docker_driver: Error device limits cannot be changed on an existing container")
+    }
+    if res.OomScoreAdj != 0 {
+        return errors.New("docker_driver: Error OOM score adjust cannot be changed on an existing container")
+    }
+    if len(res.Ulimits) > 0 {
+        return errors.New("docker_driver: Error ulimits cannot be changed on an existing container")
+    }
+    return nil
+}
+
+// Resize a container as ResizeContainer does, also changing the updatable extended resources
+// Zero mem, cpu or Resources fields keep their current values
+func ResizeContainerWithResources(cont string, mem int64, cpu float64, res Resources) (string, error) {
+    ctx := context.Background()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return "", err
+    }
+    defer cli.Close()
+
+    if err := res.checkUpdatable(); err != nil {
+        return "", err
+    }
+
+    cpus, err := daemonCPUs(ctx, cli)
+    if err != nil {
+        return "", err
+    }
+    verr := &ValidationError{}
+    validateResources(verr, mem, cpu, res, cpus)
+    if len(verr.Violations) > 0 {
+        return "", verr
+    }
+
+    resources := res.toDocker(mem, cpu)
+    if err := admitResize(ctx, cli, cont, resources); err != nil {
+        return "", err
+    }
+
+    _, err = cli.ContainerUpdate(ctx, cont, container.UpdateConfig{
+        Resources: resources,
+    })
+    if err != nil {
+        return "", err
+    }
+
+    return "success", nil
+}
@@ -0,0 +1,76 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver
+
+import (
+    "testing"
+)
+
+func TestResourcesToDocker(test *testing.T) {
+    res := Resources{
+        MemoryReservation: 64 << 20,
+        MemorySwap: -1,
+        CPUShares: 512,
+        CpusetCpus: "0-1",
+        PidsLimit: 100,
+        BlkioWeight: 300,
+        DeviceReadBps: []ThrottleDevice{{Path: "/dev/sda", Rate: 1 << 20}},
+        Ulimits: []Ulimit{{Name: "nofile", Soft: 1024, Hard: 2048}},
+    }
+
+    resources := res.toDocker(128 << 20, 0.5)
+    if resources.Memory != 128 << 20 || resources.NanoCPUs != 5e8 {
+        test.Errorf("toDocker() set memory %d and NanoCPUs %d, expected %d and %d",
+            resources.Memory, resources.NanoCPUs, 128 << 20, int64(5e8))
+    }
+    if resources.MemoryReservation != 64 << 20 || resources.MemorySwap != -1 ||
+        resources.CPUShares != 512 || resources.CpusetCpus != "0-1" || resources.BlkioWeight != 300 {
+        test.Errorf("toDocker() returned %+v, expected the extended resources to carry over", resources)
+    }
+    if resources.PidsLimit == nil || *resources.PidsLimit != 100 {
+        test.Errorf("toDocker() returned PIDs limit %v, expected 100", resources.PidsLimit)
+    }
+    if len(resources.BlkioDeviceReadBps) != 1 || resources.BlkioDeviceReadBps[0].Rate != 1 << 20 {
+        test.Errorf("toDocker() returned device read limits %v, expected /dev/sda at 1MiB/s", resources.BlkioDeviceReadBps)
+    }
+    if len(resources.Ulimits) != 1 || resources.Ulimits[0].Hard != 2048 {
+        test.Errorf("toDocker() returned ulimits %v, expected nofile", resources.Ulimits)
+    }
+
+    // Unset PIDs limit must stay nil, or resizing would reset it
+    if (Resources{}).toDocker(0, 0).PidsLimit != nil {
+        test.Errorf("toDocker() set a PIDs limit that was not asked for")
+    }
+}
+
+func TestResourcesCheckUpdatable(test *testing.T) {
+    cases := []struct {
+        name string
+        res Resources
+        ok bool
+    }{
+        {"updatable", Resources{MemoryReservation: 1 << 20, CPUShares: 512, PidsLimit: 50, BlkioWeight: 100}, true},
+        {"device", Resources{DeviceWriteIOps: []ThrottleDevice{{Path: "/dev/sda", Rate: 100}}}, false},
+        {"oom-score", Resources{OomScoreAdj: 500}, false},
+        {"ulimits", Resources{Ulimits: []Ulimit{{Name: "nproc", Soft: 10, Hard: 10}}}, false},
+    }
+
+    for _, c := range cases {
+        err := c.res.checkUpdatable()
+        if (err == nil) != c.ok {
+            test.Errorf("%s: checkUpdatable() returned %v, expected ok=%v", c.name, err, c.ok)
+        }
+    }
+}
@@ -0,0 +1,152 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver
+
+import (
+    "errors"
+    "io/ioutil"
+    "regexp"
+    "strings"
+
+    "github.com/docker/docker/api/types/container"
+    "github.com/docker/docker/api/types/strslice"
+)
+
+// Security presets
+const (
+    SecurityDefault = ""              // the daemon's defaults
+    SecurityRestricted = "restricted" // no capabilities, no privilege escalation, read-only root with a small /tmp
+)
+
+// Profile value that turns seccomp or AppArmor off
+const ProfileUnconfined = "unconfined"
+
+// Size of the writable /tmp the restricted preset mounts over its read-only root
+const restrictedTmpfs = "rw,noexec,nosuid,size=64m"
+
+// Capability names as the daemon takes them, with or without the CAP_ prefix
+var capabilityPattern = regexp.MustCompile(`^(CAP_)?[A-Z_]+$`)
+
+// Container security settings
+// Containers are never privileged; add the specific capabilities needed instead
+type SecurityOptions struct {
+    Preset string            // one of the Security* presets, fields below add to it
+    CapAdd []string          // e.g. "NET_BIND_SERVICE"
+    CapDrop []string         // "ALL" drops every capability not in CapAdd
+    ReadOnlyRootfs bool
+    NoNewPrivileges bool     // stop setuid binaries and the like from gaining privileges
+    SeccompProfile string    // ProfileUnconfined, a JSON profile or a path to one, default is the daemon's
+    AppArmorProfile string   // ProfileUnconfined or a loaded profile name, default is the daemon's
+    UsernsMode string        // "host" to opt out of the daemon's user namespace remapping
+    MaskedPaths []string     // replaces the daemon's default list, e.g. /proc/kcore
+    ReadonlyPaths []string   // replaces the daemon's default list, e.g. /proc/sys
+}
+
+// Fill in a preset's settings under the explicitly given ones
+func (sec SecurityOptions) withPreset() (SecurityOptions, error) {
+    switch sec.Preset {
+    case SecurityDefault:
+    case SecurityRestricted:
+        sec.CapDrop = append([]string{"ALL"}, sec.CapDrop...)
+        sec.ReadOnlyRootfs = true
+        sec.NoNewPrivileges = true
+    default:
+        return sec, errors.New("docker_driver: Error unknown security preset " + sec.Preset)
+    }
+    return sec, nil
+}
+
+// Problems with sec, added to verr
+func validateSecurity(verr *ValidationError, sec SecurityOptions) {
+    if sec.Preset != SecurityDefault && sec.Preset != SecurityRestricted {
+        verr.add("Security.Preset", "unknown preset %q", sec.Preset)
+    }
+    for _, capability := range sec.CapAdd {
+        if strings.ToUpper(capability) == "ALL" {
+            verr.add("Security.CapAdd", "ALL is the same as running privileged, add specific capabilities instead")
+        } else if !capabilityPattern.MatchString(strings.ToUpper(capability)) {
+            verr.add("Security.CapAdd", "%q is not a capability name", capability)
+        }
+    }
+    for _, capability := range sec.CapDrop {
+        if strings.ToUpper(capability) != "ALL" && !capabilityPattern.MatchString(strings.ToUpper(capability)) {
+            verr.add("Security.CapDrop", "%q is not a capability name", capability)
+        }
+    }
+    if sec.UsernsMode != "" && sec.UsernsMode != "host" {
+        verr.add("Security.UsernsMode", "%q must be empty or host", sec.UsernsMode)
+    }
+    if sec.AppArmorProfile != "" && strings.ContainsAny(sec.AppArmorProfile, " ,=") {
+        verr.add("Security.AppArmorProfile", "%q is not a profile name", sec.AppArmorProfile)
+    }
+    for _, path := range append(append([]string{}, sec.MaskedPaths...), sec.ReadonlyPaths...) {
+        if !strings.HasPrefix(path, "/") {
+            verr.add("Security", "path %q must be absolute", path)
+        }
+    }
+}
+
+// The daemon wants seccomp profile contents, so read paths on our side like the docker CLI does
+func seccompProfile(profile string) (string, error) {
+    if profile == "" || profile == ProfileUnconfined || strings.HasPrefix(strings.TrimSpace(profile), "{") {
+        return profile, nil
+    }
+    contents, err := ioutil.ReadFile(profile)
+    if err != nil {
+        return "", errors.New("docker_driver: Error reading seccomp profile " + err.Error())
+    }
+    return string(contents), nil
+}
+
+// Apply sec to hostConfig
+func (sec SecurityOptions) apply(hostConfig *container.HostConfig) error {
+    sec, err := sec.withPreset()
+    if err != nil {
+        return err
+    }
+
+    hostConfig.Privileged = false
+    hostConfig.CapAdd = strslice.StrSlice(sec.CapAdd)
+    hostConfig.CapDrop = strslice.StrSlice(sec.CapDrop)
+    hostConfig.ReadonlyRootfs = sec.ReadOnlyRootfs
+    hostConfig.UsernsMode = container.UsernsMode(sec.UsernsMode)
+    hostConfig.MaskedPaths = sec.MaskedPaths
+    hostConfig.ReadonlyPaths = sec.ReadonlyPaths
+
+    if sec.NoNewPrivileges {
+        hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "no-new-privileges:true")
+    }
+    profile, err := seccompProfile(sec.SeccompProfile)
+    if err != nil {
+        return err
+    }
+    if profile != "" {
+        hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "seccomp=" + profile)
+    }
+    if sec.AppArmorProfile != "" {
+        hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "apparmor=" + sec.AppArmorProfile)
+    }
+
+    // Most programs need somewhere to write, even with a read-only root
+    if sec.Preset == SecurityRestricted {
+        if hostConfig.Tmpfs == nil {
+            hostConfig.Tmpfs = make(map[string]string)
+        }
+        if _, ok := hostConfig.Tmpfs["/tmp"]; !ok {
+            hostConfig.Tmpfs["/tmp"] = restrictedTmpfs
+        }
+    }
+    return nil
+}
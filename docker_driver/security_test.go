@@ -0,0 +1,100 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver
+
+import (
+    "io/ioutil"
+    "os"
+    "reflect"
+    "testing"
+
+    "github.com/docker/docker/api/types/container"
+)
+
+func TestSecurityApply(test *testing.T) {
+    hostConfig := &container.HostConfig{}
+    sec := SecurityOptions{
+        Preset: SecurityRestricted,
+        CapAdd: []string{"NET_BIND_SERVICE"},
+        AppArmorProfile: "docker-default",
+        SeccompProfile: ProfileUnconfined,
+    }
+    if err := sec.apply(hostConfig); err != nil {
+        test.Fatalf("apply() returned:\n%v", err)
+    }
+
+    if hostConfig.Privileged || !hostConfig.ReadonlyRootfs {
+        test.Errorf("apply() set privileged %v and read-only root %v, expected false and true",
+            hostConfig.Privileged, hostConfig.ReadonlyRootfs)
+    }
+    if !reflect.DeepEqual([]string(hostConfig.CapDrop), []string{"ALL"}) ||
+        !reflect.DeepEqual([]string(hostConfig.CapAdd), []string{"NET_BIND_SERVICE"}) {
+        test.Errorf("apply() set capabilities +%v -%v, expected +NET_BIND_SERVICE -ALL", hostConfig.CapAdd, hostConfig.CapDrop)
+    }
+    expected := []string{"no-new-privileges:true", "seccomp=unconfined", "apparmor=docker-default"}
+    if !reflect.DeepEqual(hostConfig.SecurityOpt, expected) {
+        test.Errorf("apply() set security options %v, expected %v", hostConfig.SecurityOpt, expected)
+    }
+    if hostConfig.Tmpfs["/tmp"] != restrictedTmpfs {
+        test.Errorf("apply() mounted %v, expected a tmpfs on /tmp for the read-only root", hostConfig.Tmpfs)
+    }
+
+    // Default preset changes nothing
+    hostConfig = &container.HostConfig{}
+    if err := (SecurityOptions{}).apply(hostConfig); err != nil || !reflect.DeepEqual(hostConfig, &container.HostConfig{}) {
+        test.Errorf("apply() with no options set %+v, %v, expected nothing", hostConfig, err)
+    }
+}
+
+func TestSeccompProfileFile(test *testing.T) {
+    file, err := ioutil.TempFile("", "seccomp")
+    if err != nil {
+        test.Fatalf("TempFile() failed with error:\n%v", err)
+    }
+    defer os.Remove(file.Name())
+    file.WriteString(`{"defaultAction": "SCMP_ACT_ALLOW"}`)
+    file.Close()
+
+    profile, err := seccompProfile(file.Name())
+    if err != nil || profile != `{"defaultAction": "SCMP_ACT_ALLOW"}` {
+        test.Errorf("seccompProfile() returned %q, %v, expected the file contents", profile, err)
+    }
+    if _, err := seccompProfile("/nonexistent/profile.json"); err == nil {
+        test.Errorf("seccompProfile() succeeded with a missing file, expected it to fail")
+    }
+}
+
+func TestValidateSecurity(test *testing.T) {
+    cases := []struct {
+        name string
+        sec SecurityOptions
+        violations int
+    }{
+        {"restricted", SecurityOptions{Preset: SecurityRestricted, CapAdd: []string{"chown", "CAP_SETUID"}}, 0},
+        {"unknown-preset", SecurityOptions{Preset: "paranoid"}, 1},
+        {"add-all", SecurityOptions{CapAdd: []string{"all"}}, 1},
+        {"bad-capability", SecurityOptions{CapAdd: []string{"NET ADMIN"}, CapDrop: []string{"-"}}, 2},
+        {"userns", SecurityOptions{UsernsMode: "private"}, 1},
+        {"relative-path", SecurityOptions{MaskedPaths: []string{"proc/kcore"}}, 1},
+    }
+
+    for _, c := range cases {
+        verr := &ValidationError{}
+        validateSecurity(verr, c.sec)
+        if len(verr.Violations) != c.violations {
+            test.Errorf("%s: validateSecurity() found %v, expected %d violations", c.name, verr.Violations, c.violations)
+        }
+    }
+}
@@ -0,0 +1,350 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/docker/docker/api/types"
+    "github.com/docker/docker/client"
+    "golang.org/x/net/context"
+)
+
+// How often to check whether a stopped container has come back up
+const statsReconnectInterval = time.Second
+
+// Concurrent stats requests made by CollectStats unless told otherwise
+const defaultStatsWorkers = 16
+
+// Distinct failures of a single stats sample, test with errors.Is
+var (
+    ErrContainerNotFound = errors.New("docker_driver: Error container not found")
+    ErrContainerNotRunning = errors.New("docker_driver: Error container not running")
+    ErrEmptyStats = errors.New("docker_driver: Error daemon returned an empty stats sample")
+    ErrStatsDecode = errors.New("docker_driver: Error decoding stats sample")
+)
+
+// Per-interface network counters
+type NetworkMetrics struct {
+    RxBytes uint64
+    RxPackets uint64
+    RxErrors uint64
+    RxDropped uint64
+    TxBytes uint64
+    TxPackets uint64
+    TxErrors uint64
+    TxDropped uint64
+}
+
+// Resource usage of a container at one point in time
+type ContainerMetrics struct {
+    Time time.Time
+    CPUPercent float64
+    CPUPeriods uint64               // enforcement periods elapsed under a CPU limit
+    CPUThrottledPeriods uint64      // periods in which the container was throttled
+    CPUThrottledTime time.Duration  // total time the container was throttled
+    MemoryUsage uint64              // in bytes, excluding page cache
+    MemoryLimit uint64              // in bytes
+    MemoryPercent float64
+    Networks map[string]NetworkMetrics  // keyed by interface name
+    BlockRead uint64                // in bytes, summed over all devices
+    BlockWrite uint64
+    PIDs uint64
+}
+
+// One parsed sample from the daemon's stats stream
+type StatsSample struct {
+    ContainerMetrics
+    NetworkRx uint64        // in bytes, summed over all interfaces
+    NetworkTx uint64
+}
+
+func calculateContainerMetrics(stats *types.StatsJSON, cgroupVersion int) ContainerMetrics {
+    throttling := stats.CPUStats.ThrottlingData
+    metrics := ContainerMetrics{
+        Time: stats.Read,
+        CPUPercent: calculateContainerCPU(&stats.Stats),
+        CPUPeriods: throttling.Periods,
+        CPUThrottledPeriods: throttling.ThrottledPeriods,
+        CPUThrottledTime: time.Duration(throttling.ThrottledTime),
+        MemoryUsage: memoryUsage(&stats.MemoryStats, cgroupVersion),
+        MemoryLimit: stats.MemoryStats.Limit,
+        MemoryPercent: calculateContainerMemory(&stats.MemoryStats, cgroupVersion),
+        Networks: make(map[string]NetworkMetrics, len(stats.Networks)),
+        PIDs: stats.PidsStats.Current,
+    }
+
+    for name, network := range stats.Networks {
+        metrics.Networks[name] = NetworkMetrics{
+            RxBytes: network.RxBytes,
+            RxPackets: network.RxPackets,
+            RxErrors: network.RxErrors,
+            RxDropped: network.RxDropped,
+            TxBytes: network.TxBytes,
+            TxPackets: network.TxPackets,
+            TxErrors: network.TxErrors,
+            TxDropped: network.TxDropped,
+        }
+    }
+
+    // cgroup v1 reports "Read"/"Write", cgroup v2 reports "read"/"write"
+    for _, entry := range stats.BlkioStats.IoServiceBytesRecursive {
+        switch strings.ToLower(entry.Op) {
+        case "read":
+            metrics.BlockRead += entry.Value
+        case "write":
+            metrics.BlockWrite += entry.Value
+        }
+    }
+
+    return metrics
+}
+
+func newStatsSample(stats *types.StatsJSON, cgroupVersion int) StatsSample {
+    sample := StatsSample{ContainerMetrics: calculateContainerMetrics(stats, cgroupVersion)}
+    for _, network := range sample.Networks {
+        sample.NetworkRx += network.RxBytes
+        sample.NetworkTx += network.TxBytes
+    }
+    return sample
+}
+
+// Get a single snapshot of a container's resource usage
+// Blocks for about a second while the daemon takes a CPU sample
+func GetContainerMetrics(cont string) (ContainerMetrics, error) {
+    ctx := context.Background()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return ContainerMetrics{}, err
+    }
+    defer cli.Close()
+
+    cgroupVersion, err := daemonCgroupVersion(ctx, cli)
+    if err != nil {
+        return ContainerMetrics{}, err
+    }
+
+    containerStats, err := sampleStats(ctx, cli, cont)
+    if err != nil {
+        return ContainerMetrics{}, err
+    }
+
+    return calculateContainerMetrics(containerStats, cgroupVersion), nil
+}
+
+// Sample many containers concurrently
+// Since the daemon spends about a second on each CPU sample, sampling in
+// parallel takes roughly one interval as long as conts fit in the workers
+// workers bounds the number of concurrent requests, 0 uses a default of 16
+// Returns metrics for containers that were sampled and errors for those that were not
+func CollectStats(conts []string, workers int) (map[string]ContainerMetrics, map[string]error, error) {
+    ctx := context.Background()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return nil, nil, err
+    }
+    defer cli.Close()
+    // The client negotiates lazily on first use, which is not safe once
+    // the workers share it, so settle the version up front
+    cli.NegotiateAPIVersion(ctx)
+
+    cgroupVersion, err := daemonCgroupVersion(ctx, cli)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    if workers <= 0 {
+        workers = defaultStatsWorkers
+    }
+    if workers > len(conts) {
+        workers = len(conts)
+    }
+
+    results := make(map[string]ContainerMetrics, len(conts))
+    errs := make(map[string]error)
+    var mu sync.Mutex
+    var wg sync.WaitGroup
+
+    jobs := make(chan string)
+    for i := 0; i < workers; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for cont := range jobs {
+                containerStats, err := sampleStats(ctx, cli, cont)
+
+                mu.Lock()
+                if err != nil {
+                    errs[cont] = err
+                } else {
+                    results[cont] = calculateContainerMetrics(containerStats, cgroupVersion)
+                }
+                mu.Unlock()
+            }
+        }()
+    }
+
+    for _, cont := range conts {
+        jobs <- cont
+    }
+    close(jobs)
+    wg.Wait()
+
+    return results, errs, nil
+}
+
+// Take a single stats sample, always releasing the response body
+// Failures wrap ErrContainerNotFound, ErrContainerNotRunning, ErrEmptyStats or ErrStatsDecode
+func sampleStats(ctx context.Context, cli *client.Client, cont string) (*types.StatsJSON, error) {
+    resp, err := cli.ContainerStats(ctx, cont, false)
+    if err != nil {
+        if client.IsErrNotFound(err) {
+            return nil, fmt.Errorf("%w: %s", ErrContainerNotFound, cont)
+        }
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    var containerStats types.StatsJSON
+    err = json.NewDecoder(resp.Body).Decode(&containerStats)
+    if err == io.EOF {
+        return nil, fmt.Errorf("%w: %s", ErrEmptyStats, cont)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("%w: %v", ErrStatsDecode, err)
+    }
+
+    // The daemon answers with a zeroed sample rather than an error for
+    // containers that are not running
+    if containerStats.Read.IsZero() {
+        info, err := cli.ContainerInspect(ctx, cont)
+        if err != nil {
+            if client.IsErrNotFound(err) {
+                return nil, fmt.Errorf("%w: %s", ErrContainerNotFound, cont)
+            }
+            return nil, err
+        }
+        if info.State == nil || !info.State.Running {
+            return nil, fmt.Errorf("%w: %s", ErrContainerNotRunning, cont)
+        }
+        return nil, fmt.Errorf("%w: %s", ErrEmptyStats, cont)
+    }
+
+    return &containerStats, nil
+}
+
+// Stream stats samples for a container until ctx is cancelled
+// If the container stops, the stream waits for it to restart and reconnects
+// Both channels are closed when the stream ends; an error is sent first if
+// it ended for any reason other than ctx being cancelled (e.g. container removed)
+func StreamContainerStats(ctx context.Context, cont string) (<-chan StatsSample, <-chan error) {
+    samples := make(chan StatsSample)
+    errs := make(chan error, 1)
+
+    go func() {
+        defer close(errs)
+        defer close(samples)
+
+        cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+        if err != nil {
+            errs <- err
+            return
+        }
+        defer cli.Close()
+
+        cgroupVersion, err := daemonCgroupVersion(ctx, cli)
+        if err != nil {
+            if ctx.Err() == nil {
+                errs <- err
+            }
+            return
+        }
+
+        for {
+            err = streamStats(ctx, cli, cont, cgroupVersion, samples)
+            if err == nil {
+                // Stream ended because the container stopped
+                err = waitRunning(ctx, cli, cont)
+            }
+            if ctx.Err() != nil {
+                return
+            }
+            if err != nil {
+                errs <- err
+                return
+            }
+        }
+    }()
+
+    return samples, errs
+}
+
+// Forward samples from one stats connection until the daemon ends it
+// Returns nil if the stream ended cleanly
+func streamStats(ctx context.Context, cli *client.Client, cont string, cgroupVersion int, samples chan<- StatsSample) error {
+    resp, err := cli.ContainerStats(ctx, cont, true)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    decoder := json.NewDecoder(resp.Body)
+    for {
+        var containerStats types.StatsJSON
+        err := decoder.Decode(&containerStats)
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+
+        // The daemon sends zeroed samples for containers that are not running
+        if containerStats.Read.IsZero() {
+            continue
+        }
+
+        select {
+        case samples <- newStatsSample(&containerStats, cgroupVersion):
+        case <-ctx.Done():
+            return ctx.Err()
+        }
+    }
+}
+
+// Block until the container is running again
+func waitRunning(ctx context.Context, cli *client.Client, cont string) error {
+    for {
+        info, err := cli.ContainerInspect(ctx, cont)
+        if err != nil {
+            return err
+        }
+        if info.State != nil && info.State.Running {
+            return nil
+        }
+
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-time.After(statsReconnectInterval):
+        }
+    }
+}
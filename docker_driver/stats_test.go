@@ -0,0 +1,111 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver_test
+
+import (
+    "errors"
+    "fmt"
+    "testing"
+    "time"
+
+    driver "github.com/PhysarumSM/docker-driver/docker_driver"
+)
+
+func TestCheckContainerHealthErrors(test *testing.T) {
+    daemon := newFakeDaemon(test)
+    defer daemon.close()
+
+    test.Run("running", func(test *testing.T) {
+        cpu, mem, err := driver.CheckContainerHealth("running")
+        if err != nil {
+            test.Fatalf("CheckContainerHealth() returned:\n%v", err)
+        }
+        if cpu == 0 || mem == 0 {
+            test.Errorf("CheckContainerHealth() returned cpu %v mem %v, expected non-zero", cpu, mem)
+        }
+    })
+
+    cases := []struct {
+        cont string
+        expected error
+    }{
+        {"missing", driver.ErrContainerNotFound},
+        {"stopped", driver.ErrContainerNotRunning},
+        {"garbled", driver.ErrStatsDecode},
+        {"empty", driver.ErrEmptyStats},
+    }
+    for _, c := range cases {
+        test.Run(c.cont, func(test *testing.T) {
+            _, _, err := driver.CheckContainerHealth(c.cont)
+            if !errors.Is(err, c.expected) {
+                test.Errorf("CheckContainerHealth() returned %v, expected %v", err, c.expected)
+            }
+        })
+    }
+}
+
+func TestCheckContainerHealthLeak(test *testing.T) {
+    daemon := newFakeDaemon(test)
+    defer daemon.close()
+
+    const polls = 200
+    for i := 0; i < polls; i++ {
+        // Mix successful and failed polls, both must release their connections
+        cont := "running"
+        if i % 2 == 1 {
+            cont = "garbled"
+        }
+        driver.CheckContainerHealth(cont)
+    }
+
+    // Closes are observed asynchronously by the server
+    deadline := time.Now().Add(5 * time.Second)
+    for daemon.conns() > 1 && time.Now().Before(deadline) {
+        time.Sleep(10 * time.Millisecond)
+    }
+    if conns := daemon.conns(); conns > 1 {
+        test.Errorf("%d connections still open after %d polls, expected at most 1", conns, polls)
+    }
+}
+
+func TestCollectStats(test *testing.T) {
+    daemon := newFakeDaemon(test)
+    defer daemon.close()
+
+    var conts []string
+    for i := 0; i < 20; i++ {
+        conts = append(conts, fmt.Sprintf("slow%d", i))
+    }
+    conts = append(conts, "missing")
+
+    start := time.Now()
+    results, errs, err := driver.CollectStats(conts, 0)
+    elapsed := time.Since(start)
+    if err != nil {
+        test.Fatalf("CollectStats() returned:\n%v", err)
+    }
+
+    if len(results) != 20 {
+        test.Errorf("CollectStats() returned %d results, expected 20", len(results))
+    }
+    if len(errs) != 1 || !errors.Is(errs["missing"], driver.ErrContainerNotFound) {
+        test.Errorf("CollectStats() returned errors %v, expected only container (missing) to fail", errs)
+    }
+
+    // Sequential sampling would take 20 delays, the bounded pool of 16 takes two
+    if elapsed > 4 * slowStatsDelay {
+        test.Errorf("CollectStats() took %v, expected about %v", elapsed, 2 * slowStatsDelay)
+    }
+}
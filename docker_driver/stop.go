@@ -0,0 +1,216 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver
+
+import (
+    "errors"
+    "sync"
+    "time"
+
+    "github.com/docker/docker/api/types"
+    "github.com/docker/docker/api/types/container"
+    "github.com/docker/docker/client"
+    "github.com/docker/docker/errdefs"
+    "golang.org/x/net/context"
+)
+
+// Daemon defaults when neither the stop call nor the container set them
+const (
+    defaultStopSignal = "SIGTERM"
+    defaultStopTimeout = 10 * time.Second
+)
+
+// How long to remember stops we sent ourselves
+const driverStopTTL = 24 * time.Hour
+
+// Runs we stopped with our own signals, which the daemon records as kills rather than stops
+// Keyed by container ID, holding the StartedAt of the run that was stopped
+var driverStops = struct {
+    sync.Mutex
+    byID map[string]driverStop
+}{byID: make(map[string]driverStop)}
+
+type driverStop struct {
+    startedAt string
+    recorded time.Time
+}
+
+func recordDriverStop(id, startedAt string) {
+    driverStops.Lock()
+    defer driverStops.Unlock()
+    for key, stop := range driverStops.byID {
+        if time.Since(stop.recorded) > driverStopTTL {
+            delete(driverStops.byID, key)
+        }
+    }
+    driverStops.byID[id] = driverStop{startedAt: startedAt, recorded: time.Now()}
+}
+
+// Whether this process stopped the run of container id that started at startedAt
+func stoppedByDriver(id, startedAt string) bool {
+    driverStops.Lock()
+    defer driverStops.Unlock()
+    stop, ok := driverStops.byID[id]
+    return ok && stop.startedAt == startedAt
+}
+
+// Options for StopContainerWithOptions and RestartContainerWithOptions
+type StopOptions struct {
+    Timeout time.Duration   // grace period after Signal, 0 uses the container's StopTimeout
+    Signal string           // sent first, empty uses the container's StopSignal
+    NoKill bool             // return an error instead of sending SIGKILL once Timeout passes
+}
+
+// Convert DockerConfig's StopTimeout to the daemon's whole seconds
+func stopTimeoutSeconds(timeout time.Duration) *int {
+    if timeout <= 0 {
+        return nil
+    }
+    seconds := int((timeout + time.Second - 1) / time.Second)
+    return &seconds
+}
+
+// Stop a container gracefully: send the stop signal, wait for the
+// container to exit, then SIGKILL it if it is still running after the timeout
+func StopContainerWithOptions(cont string, opts StopOptions) (string, error) {
+    ctx := context.Background()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return "", err
+    }
+    defer cli.Close()
+
+    if err := stopContainer(ctx, cli, cont, opts); err != nil {
+        return "", err
+    }
+
+    return "success", nil
+}
+
+// Restart a container, stopping it gracefully as StopContainerWithOptions does
+func RestartContainerWithOptions(cont string, opts StopOptions) (string, error) {
+    ctx := context.Background()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return "", err
+    }
+    defer cli.Close()
+
+    if err := stopContainer(ctx, cli, cont, opts); err != nil {
+        return "", err
+    }
+
+    if err := cli.ContainerStart(ctx, cont, types.ContainerStartOptions{}); err != nil {
+        return "", err
+    }
+
+    return "success", nil
+}
+
+// Send a signal to a container, e.g. "SIGHUP" to reload its config
+// Empty signal sends SIGKILL
+func KillContainer(cont string, signal string) (string, error) {
+    ctx := context.Background()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return "", err
+    }
+    defer cli.Close()
+
+    if signal == "" {
+        signal = "SIGKILL"
+    }
+    if err := cli.ContainerKill(ctx, cont, signal); err != nil {
+        return "", err
+    }
+
+    return "success", nil
+}
+
+func stopContainer(ctx context.Context, cli *client.Client, cont string, opts StopOptions) error {
+    // The daemon's own stop does the same escalation and records a stop
+    // event, which GetExitReason relies on to report ExitStopped
+    if opts.Signal == "" && !opts.NoKill {
+        var timeout *time.Duration
+        if opts.Timeout > 0 {
+            timeout = &opts.Timeout
+        }
+        return cli.ContainerStop(ctx, cont, timeout)
+    }
+
+    info, err := cli.ContainerInspect(ctx, cont)
+    if err != nil {
+        return err
+    }
+    if info.State == nil || !info.State.Running {
+        return nil
+    }
+
+    signal := opts.Signal
+    if signal == "" && info.Config != nil {
+        signal = info.Config.StopSignal
+    }
+    if signal == "" {
+        signal = defaultStopSignal
+    }
+
+    timeout := opts.Timeout
+    if timeout <= 0 && info.Config != nil && info.Config.StopTimeout != nil {
+        timeout = time.Duration(*info.Config.StopTimeout) * time.Second
+    }
+    if timeout <= 0 {
+        timeout = defaultStopTimeout
+    }
+
+    // Sending the signal ourselves records a kill, not a stop, so remember it for GetExitReason
+    recordDriverStop(info.ID, info.State.StartedAt)
+
+    // not-running also returns if the container exits before the wait is registered
+    waitCtx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    exited, waitErrs := cli.ContainerWait(waitCtx, info.ID, container.WaitConditionNotRunning)
+
+    if err := cli.ContainerKill(ctx, info.ID, signal); err != nil {
+        return err
+    }
+
+    select {
+    case <-exited:
+        return nil
+    case err := <-waitErrs:
+        return err
+    case <-time.After(timeout):
+    }
+
+    if opts.NoKill {
+        // Still running, so whatever ends it later was not this stop
+        driverStops.Lock()
+        delete(driverStops.byID, info.ID)
+        driverStops.Unlock()
+        return errors.New("docker_driver: Error container did not stop within timeout " + cont)
+    }
+
+    // Conflict means it exited on its own just before the SIGKILL
+    if err := cli.ContainerKill(ctx, info.ID, "SIGKILL"); err != nil && !errdefs.IsConflict(err) {
+        return err
+    }
+
+    select {
+    case <-exited:
+        return nil
+    case err := <-waitErrs:
+        return err
+    }
+}
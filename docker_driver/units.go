@@ -0,0 +1,171 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver
+
+import (
+    "encoding/json"
+    "errors"
+    "math"
+    "strconv"
+    "strings"
+
+    "github.com/docker/go-units"
+)
+
+// Binary units FormatMemory picks from, largest first
+var memoryUnits = []struct {
+    size int64
+    suffix string
+}{
+    {units.PiB, "PiB"},
+    {units.TiB, "TiB"},
+    {units.GiB, "GiB"},
+    {units.MiB, "MiB"},
+    {units.KiB, "KiB"},
+}
+
+// Parse a memory size such as "512m", "256MiB" or "1073741824" into bytes
+// Units are binary as in the docker CLI, so "512m", "512MB" and "512MiB" are all 512 * 1024 * 1024
+// "-1" is accepted for limits where it means unlimited, such as MemorySwap
+func ParseMemory(size string) (int64, error) {
+    size = strings.TrimSpace(size)
+    if size == "-1" {
+        return -1, nil
+    }
+    bytes, err := units.RAMInBytes(size)
+    if err != nil {
+        return 0, errors.New("docker_driver: Error invalid memory size " + strconv.Quote(size))
+    }
+    return bytes, nil
+}
+
+// Format bytes in the largest binary unit that holds it exactly, e.g. "256MiB"
+// Sizes that are not a whole number of KiB are formatted as plain bytes
+func FormatMemory(bytes int64) string {
+    for _, unit := range memoryUnits {
+        if bytes != 0 && bytes % unit.size == 0 {
+            return strconv.FormatInt(bytes / unit.size, 10) + unit.suffix
+        }
+    }
+    return strconv.FormatInt(bytes, 10)
+}
+
+// Parse a CPU count such as "1.5" or "750m" (millicores) into cores
+func ParseCPU(cpu string) (float64, error) {
+    cpu = strings.TrimSpace(cpu)
+    scale := 1.0
+    number := cpu
+    if strings.HasSuffix(cpu, "m") {
+        scale = 1000
+        number = strings.TrimSuffix(cpu, "m")
+    }
+
+    value, err := strconv.ParseFloat(number, 64)
+    if err != nil || value < 0 || math.IsInf(value, 0) || math.IsNaN(value) {
+        return 0, errors.New("docker_driver: Error invalid CPU count " + strconv.Quote(cpu))
+    }
+    return value / scale, nil
+}
+
+// Format cores as millicores when below one core, e.g. "750m", otherwise as a decimal, e.g. "1.5"
+func FormatCPU(cpu float64) string {
+    millis := cpu * 1000
+    if cpu > 0 && cpu < 1 && millis == math.Trunc(millis) {
+        return strconv.FormatFloat(millis, 'f', -1, 64) + "m"
+    }
+    return strconv.FormatFloat(cpu, 'f', -1, 64)
+}
+
+// Memory size in bytes that reads and writes human-readable text, e.g. "512m"
+type MemorySize int64
+
+func (size MemorySize) MarshalText() ([]byte, error) {
+    return []byte(FormatMemory(int64(size))), nil
+}
+
+func (size *MemorySize) UnmarshalText(text []byte) error {
+    bytes, err := ParseMemory(string(text))
+    if err != nil {
+        return err
+    }
+    *size = MemorySize(bytes)
+    return nil
+}
+
+// Accepts a JSON number of bytes as well as a string
+func (size *MemorySize) UnmarshalJSON(data []byte) error {
+    var bytes int64
+    if err := json.Unmarshal(data, &bytes); err == nil {
+        *size = MemorySize(bytes)
+        return nil
+    }
+
+    var text string
+    if err := json.Unmarshal(data, &text); err != nil {
+        return errors.New("docker_driver: Error memory size must be a number of bytes or a string")
+    }
+    return size.UnmarshalText([]byte(text))
+}
+
+// CPU count in cores that reads and writes human-readable text, e.g. "750m"
+type CPUs float64
+
+func (cpu CPUs) MarshalText() ([]byte, error) {
+    return []byte(FormatCPU(float64(cpu))), nil
+}
+
+func (cpu *CPUs) UnmarshalText(text []byte) error {
+    cores, err := ParseCPU(string(text))
+    if err != nil {
+        return err
+    }
+    *cpu = CPUs(cores)
+    return nil
+}
+
+// Accepts a JSON number of cores as well as a string
+func (cpu *CPUs) UnmarshalJSON(data []byte) error {
+    var cores float64
+    if err := json.Unmarshal(data, &cores); err == nil {
+        *cpu = CPUs(cores)
+        return nil
+    }
+
+    var text string
+    if err := json.Unmarshal(data, &text); err != nil {
+        return errors.New("docker_driver: Error CPU count must be a number of cores or a string")
+    }
+    return cpu.UnmarshalText([]byte(text))
+}
+
+// Decode a DockerConfig, accepting Memory and Cpu as strings such as "256MiB" and "750m"
+// as well as plain numbers
+func (opt *DockerConfig) UnmarshalJSON(data []byte) error {
+    // plain has no methods, so decoding into it does not recurse
+    type plain DockerConfig
+    decoded := struct {
+        *plain
+        Memory MemorySize
+        Cpu CPUs
+    }{plain: (*plain)(opt), Memory: MemorySize(opt.Memory), Cpu: CPUs(opt.Cpu)}
+
+    if err := json.Unmarshal(data, &decoded); err != nil {
+        return err
+    }
+
+    opt.Memory = int64(decoded.Memory)
+    opt.Cpu = float64(decoded.Cpu)
+    return nil
+}
@@ -0,0 +1,128 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver_test
+
+import (
+    "encoding/json"
+    "testing"
+
+    driver "github.com/PhysarumSM/docker-driver/docker_driver"
+)
+
+func TestParseMemory(test *testing.T) {
+    cases := []struct {
+        size string
+        bytes int64
+        ok bool
+    }{
+        {"512m", 512 << 20, true},
+        {"256MiB", 256 << 20, true},
+        {"256MB", 256 << 20, true},
+        {"1.5g", 3 << 29, true},
+        {"4096", 4096, true},
+        {" 1k ", 1024, true},
+        {"", 0, false},
+        {"-1m", 0, false},
+        {"12 parsecs", 0, false},
+    }
+
+    for _, c := range cases {
+        bytes, err := driver.ParseMemory(c.size)
+        if (err == nil) != c.ok || bytes != c.bytes {
+            test.Errorf("ParseMemory(%q) returned %d, %v, expected %d, ok=%v", c.size, bytes, err, c.bytes, c.ok)
+        }
+    }
+}
+
+func TestFormatMemory(test *testing.T) {
+    cases := map[int64]string{
+        0: "0",
+        1000: "1000",
+        256 << 20: "256MiB",
+        3 << 29: "1536MiB",
+        2 << 30: "2GiB",
+        10e+6: "10000000",
+    }
+
+    for bytes, expected := range cases {
+        if formatted := driver.FormatMemory(bytes); formatted != expected {
+            test.Errorf("FormatMemory(%d) returned %q, expected %q", bytes, formatted, expected)
+        }
+        // Formatting is exact, so it always parses back
+        if parsed, err := driver.ParseMemory(driver.FormatMemory(bytes)); err != nil || parsed != bytes {
+            test.Errorf("ParseMemory(FormatMemory(%d)) returned %d, %v", bytes, parsed, err)
+        }
+    }
+}
+
+func TestParseCPU(test *testing.T) {
+    cases := []struct {
+        cpu string
+        cores float64
+        ok bool
+    }{
+        {"1.5", 1.5, true},
+        {"750m", 0.75, true},
+        {"2000m", 2, true},
+        {"0", 0, true},
+        {"m", 0, false},
+        {"-1", 0, false},
+        {"1.5cores", 0, false},
+    }
+
+    for _, c := range cases {
+        cores, err := driver.ParseCPU(c.cpu)
+        if (err == nil) != c.ok || cores != c.cores {
+            test.Errorf("ParseCPU(%q) returned %g, %v, expected %g, ok=%v", c.cpu, cores, err, c.cores, c.ok)
+        }
+    }
+
+    for cores, expected := range map[float64]string{0.75: "750m", 1.5: "1.5", 2: "2", 0: "0"} {
+        if formatted := driver.FormatCPU(cores); formatted != expected {
+            test.Errorf("FormatCPU(%g) returned %q, expected %q", cores, formatted, expected)
+        }
+    }
+}
+
+func TestDockerConfigUnmarshalJSON(test *testing.T) {
+    var opt driver.DockerConfig
+    err := json.Unmarshal([]byte(`{"Image": "busybox", "Memory": "256MiB", "Cpu": "750m"}`), &opt)
+    if err != nil {
+        test.Fatalf("Unmarshal() returned:\n%v", err)
+    }
+    if opt.Image != "busybox" || opt.Memory != 256 << 20 || opt.Cpu != 0.75 {
+        test.Errorf("Unmarshal() decoded %+v, expected busybox with 256MiB and 0.75 cores", opt)
+    }
+
+    // Plain numbers still work
+    err = json.Unmarshal([]byte(`{"Memory": 10000000, "Cpu": 1.5}`), &opt)
+    if err != nil || opt.Memory != 10e+6 || opt.Cpu != 1.5 || opt.Image != "busybox" {
+        test.Errorf("Unmarshal() decoded %+v, %v, expected numeric memory and CPU", opt, err)
+    }
+
+    err = json.Unmarshal([]byte(`{"Memory": "lots"}`), &opt)
+    if err == nil {
+        test.Errorf("Unmarshal() accepted memory \"lots\", expected it to fail")
+    }
+
+    var size driver.MemorySize
+    if err := size.UnmarshalText([]byte("512m")); err != nil || size != 512 << 20 {
+        test.Errorf("UnmarshalText(512m) returned %d, %v", size, err)
+    }
+    text, _ := driver.CPUs(0.25).MarshalText()
+    if string(text) != "250m" {
+        test.Errorf("CPUs(0.25).MarshalText() returned %q, expected 250m", text)
+    }
+}
@@ -0,0 +1,212 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver
+
+import (
+    "fmt"
+    "regexp"
+    "strings"
+
+    "github.com/docker/docker/api/types"
+    "github.com/docker/docker/client"
+    "github.com/docker/go-connections/nat"
+    "golang.org/x/net/context"
+)
+
+// Smallest memory limit we allow, the kernel needs some headroom to start anything
+const minMemory = 4 * 1024 * 1024
+
+// Same rule the daemon applies to container names
+var containerNamePattern = regexp.MustCompile(`^/?[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+// RFC 1123 host name label, which is all the daemon accepts for Hostname
+var hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// Networks that always exist, or refer to another container rather than a network
+var builtinNetworks = map[string]bool{"": true, "default": true, "bridge": true, "host": true, "none": true}
+
+// One problem found with a DockerConfig
+type Violation struct {
+    Field string      // DockerConfig field, e.g. "Memory" or "Resources.CPUQuota"
+    Message string
+}
+
+// Every problem found with a DockerConfig, returned by Validate
+type ValidationError struct {
+    Violations []Violation
+}
+
+func (err *ValidationError) Error() string {
+    msgs := make([]string, len(err.Violations))
+    for i, violation := range err.Violations {
+        msgs[i] = violation.Field + ": " + violation.Message
+    }
+    return "docker_driver: Error invalid config: " + strings.Join(msgs, "; ")
+}
+
+func (err *ValidationError) add(field, format string, args ...interface{}) {
+    err.Violations = append(err.Violations, Violation{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Check opt against the daemon before creating anything
+// Returns a *ValidationError listing every violation, or nil if opt is valid
+func (opt DockerConfig) Validate() error {
+    ctx := context.Background()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return err
+    }
+    defer cli.Close()
+
+    return opt.validate(ctx, cli)
+}
+
+func (opt DockerConfig) validate(ctx context.Context, cli *client.Client) error {
+    cpus, err := daemonCPUs(ctx, cli)
+    if err != nil {
+        return err
+    }
+
+    verr := &ValidationError{}
+
+    if opt.Image == "" {
+        verr.add("Image", "must be set")
+    }
+    validateName(verr, opt.Name)
+
+    if opt.Hostname != "" && !hostnamePattern.MatchString(opt.Hostname) {
+        verr.add("Hostname", "%q must be a single host name label of letters, digits and '-'", opt.Hostname)
+    }
+    if opt.Hostname != "" && opt.Network == "host" {
+        verr.add("Hostname", "cannot be set with the host network")
+    }
+
+    validatePort(verr, opt.Port)
+
+    for _, env := range opt.Env {
+        if i := strings.Index(env, "="); i <= 0 || strings.TrimSpace(env[:i]) != env[:i] {
+            verr.add("Env", "%q must be in KEY=value form", env)
+        }
+    }
+
+    validateResources(verr, opt.Memory, opt.Cpu, opt.Resources, cpus)
+    if opt.Resources.MemorySwap > 0 && opt.Memory == 0 {
+        verr.add("Resources.MemorySwap", "can only be set along with Memory")
+    }
+
+    opt.RestartPolicy.validate(verr)
+    opt.HealthCheck.validate(verr)
+    if opt.StopTimeout < 0 {
+        verr.add("StopTimeout", "%v cannot be negative", opt.StopTimeout)
+    }
+
+    validateSecurity(verr, opt.Security)
+
+    err = validateNetwork(ctx, cli, verr, opt.Network)
+    if err != nil {
+        return err
+    }
+
+    if len(verr.Violations) > 0 {
+        return verr
+    }
+    return nil
+}
+
+// Shared with ContainerPool.Acquire, which renames warm containers
+func validateName(verr *ValidationError, name string) {
+    if name != "" && !containerNamePattern.MatchString(name) {
+        verr.add("Name", "%q must start with a letter or digit and contain only letters, digits, '_', '.' and '-'", name)
+    }
+}
+
+// Container port as "80" or "80/udp", host port as "8080" or empty for none
+func validatePort(verr *ValidationError, port [2]string) {
+    if port[0] == "" {
+        if port[1] != "" {
+            verr.add("Port", "host port %q given without a container port", port[1])
+        }
+        return
+    }
+
+    proto, number := nat.SplitProtoPort(port[0])
+    if proto != "tcp" && proto != "udp" && proto != "sctp" {
+        verr.add("Port", "container port %q has unknown protocol %q", port[0], proto)
+    }
+    if n, err := nat.ParsePort(number); err != nil || n == 0 {
+        verr.add("Port", "container port %q must be a number between 1 and 65535", port[0])
+    }
+    if port[1] != "" {
+        if _, err := nat.ParsePort(port[1]); err != nil {
+            verr.add("Port", "host port %q must be a number between 0 and 65535", port[1])
+        }
+    }
+}
+
+// Shared with ResizeContainerWithResources, where zero means unchanged
+func validateResources(verr *ValidationError, memory int64, cpu float64, res Resources, cpus int) {
+    if memory < 0 || (memory > 0 && memory < minMemory) {
+        verr.add("Memory", "%d bytes is below the 4MiB minimum", memory)
+    }
+    if cpu < 0 || cpu > float64(cpus) {
+        verr.add("Cpu", "%g must be between 0 and the host's %d cores", cpu, cpus)
+    }
+
+    if res.MemoryReservation < 0 || (memory > 0 && res.MemoryReservation > memory) {
+        verr.add("Resources.MemoryReservation", "%d bytes must be between 0 and Memory", res.MemoryReservation)
+    }
+    if res.MemorySwap < -1 || (res.MemorySwap > 0 && memory > 0 && res.MemorySwap < memory) {
+        verr.add("Resources.MemorySwap", "%d bytes must be -1, or at least Memory", res.MemorySwap)
+    }
+    if res.CPUShares < 0 {
+        verr.add("Resources.CPUShares", "%d cannot be negative", res.CPUShares)
+    }
+    if (res.CPUPeriod != 0 || res.CPUQuota != 0) && cpu != 0 {
+        verr.add("Resources.CPUQuota", "CPUPeriod and CPUQuota cannot be combined with Cpu")
+    }
+    if res.CPUPeriod != 0 && (res.CPUPeriod < 1000 || res.CPUPeriod > 1000000) {
+        verr.add("Resources.CPUPeriod", "%dus must be between 1ms and 1s", res.CPUPeriod)
+    }
+    if res.CPUQuota != 0 && res.CPUQuota < 1000 {
+        verr.add("Resources.CPUQuota", "%dus must be at least 1ms", res.CPUQuota)
+    }
+    if res.PidsLimit < -1 {
+        verr.add("Resources.PidsLimit", "%d must be -1 (unlimited) or positive", res.PidsLimit)
+    }
+    if res.BlkioWeight != 0 && (res.BlkioWeight < 10 || res.BlkioWeight > 1000) {
+        verr.add("Resources.BlkioWeight", "%d must be between 10 and 1000", res.BlkioWeight)
+    }
+    if res.OomScoreAdj < -1000 || res.OomScoreAdj > 1000 {
+        verr.add("Resources.OomScoreAdj", "%d must be between -1000 and 1000", res.OomScoreAdj)
+    }
+    for _, ulimit := range res.Ulimits {
+        if ulimit.Name == "" || ulimit.Soft > ulimit.Hard {
+            verr.add("Resources.Ulimits", "%q needs a name and a soft limit no higher than its hard limit", ulimit.Name)
+        }
+    }
+}
+
+func validateNetwork(ctx context.Context, cli *client.Client, verr *ValidationError, network string) error {
+    if builtinNetworks[network] || strings.HasPrefix(network, "container:") {
+        return nil
+    }
+
+    _, err := cli.NetworkInspect(ctx, network, types.NetworkInspectOptions{})
+    if client.IsErrNotFound(err) {
+        verr.add("Network", "%q does not exist", network)
+        return nil
+    }
+    return err
+}
@@ -0,0 +1,112 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver_test
+
+import (
+    "errors"
+    "net/http"
+    "testing"
+    "time"
+
+    driver "github.com/PhysarumSM/docker-driver/docker_driver"
+)
+
+func serveValidate(daemon *fakeDaemon) *int {
+    creates := 0
+    daemon.handle("/info", func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(`{"NCPU": 2}`))
+    })
+    daemon.handle("/networks/backend", func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(`{"Name": "backend", "Id": "n1"}`))
+    })
+    daemon.handle("/networks/nosuchnet", func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusNotFound)
+        w.Write([]byte(`{"message": "network nosuchnet not found"}`))
+    })
+    daemon.handle("/containers/create", func(w http.ResponseWriter, r *http.Request) {
+        creates++
+        w.WriteHeader(http.StatusInternalServerError)
+    })
+    return &creates
+}
+
+func TestValidate(test *testing.T) {
+    daemon := newFakeDaemon(test)
+    defer daemon.close()
+    creates := serveValidate(daemon)
+
+    valid := driver.DockerConfig{
+        Name: "web-1",
+        Image: "busybox",
+        Port: [2]string{"8080/tcp", "80"},
+        Memory: 64 << 20,
+        Cpu: 1.5,
+        Network: "backend",
+        Env: []string{"A=1", "B="},
+        Hostname: "web-1",
+        Domainname: "example.com",
+    }
+    if err := valid.Validate(); err != nil {
+        test.Errorf("Validate() returned %v for a valid config", err)
+    }
+
+    invalid := driver.DockerConfig{
+        Name: "-web",
+        Image: "busybox",
+        Port: [2]string{"http", "99999"},
+        Memory: 1 << 20,
+        Cpu: 4,
+        Network: "nosuchnet",
+        Env: []string{"NOVALUE", "=1"},
+        Hostname: "web.example.com",
+        Resources: driver.Resources{BlkioWeight: 5},
+        RestartPolicy: driver.RestartPolicy{Name: driver.RestartAlways, MaxRetries: 3},
+        HealthCheck: &driver.HealthCheck{Cmd: []string{"true"}, Interval: -time.Second, Retries: -1},
+        StopTimeout: -time.Second,
+    }
+    err := invalid.Validate()
+    var verr *driver.ValidationError
+    if !errors.As(err, &verr) {
+        test.Fatalf("Validate() returned %v, expected a *ValidationError", err)
+    }
+
+    fields := make(map[string]int)
+    for _, violation := range verr.Violations {
+        fields[violation.Field]++
+    }
+    expected := map[string]int{
+        "Name": 1, "Port": 2, "Memory": 1, "Cpu": 1, "Network": 1, "Env": 2, "Hostname": 1, "Resources.BlkioWeight": 1,
+        "RestartPolicy.MaxRetries": 1, "HealthCheck.Interval": 1, "HealthCheck.Retries": 1, "StopTimeout": 1,
+    }
+    for field, n := range expected {
+        if fields[field] != n {
+            test.Errorf("Validate() reported %d violations of %s, expected %d:\n%v", fields[field], field, n, err)
+        }
+    }
+
+    // Rejected before anything is created
+    _, err = driver.RunContainer(invalid)
+    if !errors.As(err, &verr) {
+        test.Errorf("RunContainer() returned %v, expected a *ValidationError", err)
+    }
+    if *creates != 0 {
+        test.Errorf("RunContainer() created a container from an invalid config")
+    }
+
+    _, err = driver.ResizeContainer("abc", 1 << 20, 8)
+    if !errors.As(err, &verr) || len(verr.Violations) != 2 {
+        test.Errorf("ResizeContainer() returned %v, expected memory and CPU violations", err)
+    }
+}
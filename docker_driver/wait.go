@@ -0,0 +1,277 @@
+/* Copyright 2020 PhysarumSM Development Team
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package docker_driver
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/docker/docker/api/types"
+    "github.com/docker/docker/api/types/container"
+    "github.com/docker/docker/client"
+    "github.com/docker/go-connections/nat"
+    "golang.org/x/net/context"
+)
+
+// Conditions accepted by WaitContainer
+const (
+    WaitNotRunning = string(container.WaitConditionNotRunning)
+    WaitNextExit = string(container.WaitConditionNextExit)
+    WaitRemoved = string(container.WaitConditionRemoved)
+)
+
+const (
+    defaultReadyInterval = 500 * time.Millisecond
+    defaultReadyLogLines = 20
+)
+
+// Options for WaitReady
+// With no Port set, readiness is decided by the daemon's health status
+// (or just running, if the container has no health check)
+type ReadyOptions struct {
+    Timeout time.Duration   // 0 waits forever
+    Interval time.Duration  // time between checks, default 500ms
+    Port string             // container port to probe, e.g. "8080" or "8080/tcp"
+    HTTPPath string         // if set, probe with HTTP GET instead of a TCP connect
+    LogLines int            // log lines to attach on failure, default 20
+}
+
+// Returned by WaitReady when the container never became ready
+type ReadyError struct {
+    Cont string
+    Reason string
+    Logs []string           // last log lines of the container
+}
+
+func (err *ReadyError) Error() string {
+    return fmt.Sprintf("docker_driver: Error container %s not ready: %s", err.Cont, err.Reason)
+}
+
+// Block until the container reaches condition (WaitNotRunning, WaitNextExit or WaitRemoved)
+// Returns the container's exit code
+// timeout of 0 waits forever
+func WaitContainer(cont string, condition string, timeout time.Duration) (int64, error) {
+    ctx := context.Background()
+    if timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, timeout)
+        defer cancel()
+    }
+
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return 0, err
+    }
+    defer cli.Close()
+
+    switch condition {
+    case WaitNotRunning, WaitNextExit, WaitRemoved:
+    default:
+        return 0, errors.New("docker_driver: Error unknown wait condition " + condition)
+    }
+
+    respC, errC := cli.ContainerWait(ctx, cont, container.WaitCondition(condition))
+    select {
+    case resp := <-respC:
+        if resp.Error != nil && resp.Error.Message != "" {
+            return resp.StatusCode, errors.New(resp.Error.Message)
+        }
+        return resp.StatusCode, nil
+    case err := <-errC:
+        return 0, err
+    }
+}
+
+// Block until the container is running and ready to serve
+// Ready means the configured TCP/HTTP probe succeeds, or if no probe is
+// configured, the daemon reports the container healthy
+func WaitReady(cont string, opts ReadyOptions) error {
+    ctx := context.Background()
+    if opts.Timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+        defer cancel()
+    }
+    if opts.Interval <= 0 {
+        opts.Interval = defaultReadyInterval
+    }
+    if opts.LogLines <= 0 {
+        opts.LogLines = defaultReadyLogLines
+    }
+
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return err
+    }
+    defer cli.Close()
+
+    reason := "timed out"
+    for {
+        ready, notReadyReason, err := checkReady(ctx, cli, cont, opts)
+        if err != nil {
+            return err
+        }
+        if ready {
+            return nil
+        }
+        if notReadyReason != "" {
+            reason = notReadyReason
+        }
+
+        select {
+        case <-ctx.Done():
+            return readyError(cli, cont, "timed out waiting, last check: " + reason, opts.LogLines)
+        case <-time.After(opts.Interval):
+        }
+    }
+}
+
+// A single readiness check
+// Returns an error only for conditions that can never become ready
+func checkReady(ctx context.Context, cli *client.Client, cont string, opts ReadyOptions) (bool, string, error) {
+    info, err := cli.ContainerInspect(ctx, cont)
+    if err != nil {
+        if client.IsErrNotFound(err) {
+            return false, "", err
+        }
+        // Timeouts and transient daemon errors are retried until the deadline
+        return false, err.Error(), nil
+    }
+
+    state := info.State
+    if state == nil || !state.Running {
+        if state != nil && state.Status == "exited" && !restartExpected(info) {
+            reason := fmt.Sprintf("exited with code %d", state.ExitCode)
+            return false, "", readyError(cli, cont, reason, opts.LogLines)
+        }
+        return false, "not running", nil
+    }
+
+    if opts.Port != "" {
+        addr, err := publishedAddr(info, opts.Port)
+        if err != nil {
+            return false, "", err
+        }
+        if err := probe(ctx, addr, opts.HTTPPath, opts.Interval); err != nil {
+            return false, err.Error(), nil
+        }
+        return true, "", nil
+    }
+
+    if state.Health == nil || state.Health.Status == HealthNone {
+        return true, "", nil
+    }
+    if state.Health.Status == HealthHealthy {
+        return true, "", nil
+    }
+    return false, "health status " + state.Health.Status, nil
+}
+
+// Exited containers with a restart policy may still come back up
+func restartExpected(info types.ContainerJSON) bool {
+    if info.HostConfig == nil {
+        return false
+    }
+    return !info.HostConfig.RestartPolicy.IsNone()
+}
+
+// Host address a container port is published on
+// Containers on the host network are reached on the container port directly
+func publishedAddr(info types.ContainerJSON, port string) (string, error) {
+    if !strings.Contains(port, "/") {
+        port = port + "/tcp"
+    }
+    contPort := nat.Port(port)
+
+    if info.HostConfig != nil && info.HostConfig.NetworkMode.IsHost() {
+        return net.JoinHostPort("127.0.0.1", contPort.Port()), nil
+    }
+
+    if info.NetworkSettings != nil {
+        for _, binding := range info.NetworkSettings.Ports[contPort] {
+            host := binding.HostIP
+            if host == "" || host == "0.0.0.0" || host == "::" {
+                host = "127.0.0.1"
+            }
+            if binding.HostPort != "" {
+                return net.JoinHostPort(host, binding.HostPort), nil
+            }
+        }
+    }
+
+    return "", errors.New("docker_driver: Error port " + port + " is not published")
+}
+
+// TCP connect, or HTTP GET if path is set (any status below 400 is ready)
+func probe(ctx context.Context, addr, path string, timeout time.Duration) error {
+    if path == "" {
+        dialer := net.Dialer{Timeout: timeout}
+        conn, err := dialer.DialContext(ctx, "tcp", addr)
+        if err != nil {
+            return err
+        }
+        return conn.Close()
+    }
+
+    if !strings.HasPrefix(path, "/") {
+        path = "/" + path
+    }
+    req, err := http.NewRequest(http.MethodGet, "http://" + addr + path, nil)
+    if err != nil {
+        return err
+    }
+    httpClient := http.Client{Timeout: timeout}
+    resp, err := httpClient.Do(req.WithContext(ctx))
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+
+    if resp.StatusCode >= 400 {
+        return errors.New("HTTP probe returned " + strconv.Itoa(resp.StatusCode))
+    }
+    return nil
+}
+
+// Build a ReadyError carrying the container's last log lines
+// Uses a fresh context since the wait's context may have already expired
+func readyError(cli *client.Client, cont, reason string, lines int) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+    defer cancel()
+
+    logs, _ := tailLogs(ctx, cli, cont, lines)
+    return &ReadyError{Cont: cont, Reason: reason, Logs: logs}
+}
+
+// Last lines of a container's stdout and stderr, interleaved
+func tailLogs(ctx context.Context, cli *client.Client, cont string, lines int) ([]string, error) {
+    var buf bytes.Buffer
+    err := copyLogs(ctx, cli, cont, LogOptions{Tail: lines}.toDocker(false), &buf, &buf)
+    if err != nil {
+        return nil, err
+    }
+
+    output := strings.TrimRight(buf.String(), "\r\n")
+    if output == "" {
+        return nil, nil
+    }
+    return strings.Split(output, "\n"), nil
+}